@@ -0,0 +1,84 @@
+package panoptes_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watcher backpressure", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = sc.NewTest()
+	})
+
+	n := 50
+
+	// fill creates n files while nothing reads the events of a watcher with
+	// a buffer of 4 and returns the expected events.
+	fill := func(p panoptes.Backpressure) (*seqChecker, func() panoptes.Stats, []panoptes.Event) {
+		w, c := newNativeWatcher(dir, panoptes.WithEventBufferSize(4), panoptes.WithBackpressure(p))
+
+		var expected []panoptes.Event
+		for i := 0; i < n; i++ {
+			expected = append(expected, createFile(filepath.Join(dir, fmt.Sprintf("file%d.txt", i)), "ohai"))
+		}
+		return c, w.Stats, expected
+	}
+
+	It("should block until the consumer reads", func() {
+		c, stats, expected := fill(panoptes.BackpressureBlock)
+		defer closeWatcher(c)
+
+		Eventually(func() int { return stats().Blocked }).ShouldNot(BeZero())
+		for _, e := range expected {
+			Eventually(c.Events(), time.Minute).Should(Receive(Equal(e)))
+		}
+		Expect(stats().Dropped).To(BeZero())
+		Expect(stats().Spilled).To(BeZero())
+	})
+
+	It("should drop events and report an overflow", func() {
+		c, stats, expected := fill(panoptes.BackpressureDrop)
+		defer c.Close()
+
+		Eventually(func() int { return stats().Dropped }).ShouldNot(BeZero())
+		got := map[string]bool{}
+		for {
+			var e panoptes.Event
+			Eventually(c.Events(), time.Minute).Should(Receive(&e))
+			if e.Op == panoptes.Overflow {
+				Expect(e).To(Equal(panoptes.Event{Path: dir, Op: panoptes.Overflow, IsDir: true, Root: dir}))
+				break
+			}
+			got[e.Path] = true
+		}
+		Expect(len(got)).To(BeNumerically("<", len(expected)))
+		Expect(stats().Blocked).To(BeZero())
+		Eventually(func() int { return stats().Backlog }).Should(BeZero())
+	})
+
+	It("should spill events and deliver them in order", func() {
+		c, stats, expected := fill(panoptes.BackpressureSpill)
+		defer closeWatcher(c)
+
+		Eventually(func() int { return stats().Spilled }).ShouldNot(BeZero())
+		Expect(stats().Backlog).NotTo(BeZero())
+		for _, e := range expected {
+			Eventually(c.Events(), time.Minute).Should(Receive(Equal(e)))
+		}
+		Expect(stats().Dropped).To(BeZero())
+		Expect(stats().Backlog).To(BeZero())
+	})
+
+	It("should reject an unknown policy", func() {
+		_, err := panoptes.NewWatcher(dir, panoptes.WithBackpressure(panoptes.Backpressure(42)))
+		Expect(err).To(MatchError("Invalid backpressure policy: 42"))
+	})
+})
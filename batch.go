@@ -0,0 +1,144 @@
+package panoptes
+
+import (
+	"sync"
+	"time"
+)
+
+// Batcher wraps a Watcher and delivers its events in slices. A batch is
+// flushed when it holds maxSize events, when its oldest event waited for
+// maxLatency or when the wrapped watcher has no more events queued. Events
+// keep their order within and across batches.
+type Batcher struct {
+	w          Watcher
+	maxSize    int
+	maxLatency time.Duration
+	batches    chan []Event
+	errors     chan error
+	quitCh     chan error
+	doneCh     chan struct{}
+	closeOnce  sync.Once
+}
+
+func NewBatcher(w Watcher, maxSize int, maxLatency time.Duration) *Batcher {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+
+	b := &Batcher{
+		w:          w,
+		maxSize:    maxSize,
+		maxLatency: maxLatency,
+		batches:    make(chan []Event),
+		errors:     make(chan error),
+		quitCh:     make(chan error),
+		doneCh:     make(chan struct{}),
+	}
+
+	go b.run()
+
+	return b
+}
+
+func (b *Batcher) run() {
+	defer func() {
+		close(b.batches)
+		close(b.errors)
+		close(b.doneCh)
+	}()
+
+	var batch []Event
+	timer := time.NewTimer(b.maxLatency)
+	timer.Stop()
+
+	flush := func() bool {
+		if !timer.Stop() {
+			// fired meanwhile, the next batch must not see it
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if len(batch) == 0 {
+			return true
+		}
+		select {
+		case b.batches <- batch:
+			batch = nil
+			return true
+		case <-b.quitCh:
+			return false
+		}
+	}
+
+	for {
+		var timerC <-chan time.Time
+		if len(batch) > 0 {
+			timerC = timer.C
+		}
+
+		select {
+		case <-b.quitCh:
+			return
+		case err, ok := <-b.w.Errors():
+			if !ok {
+				return
+			}
+			select {
+			case b.errors <- err:
+			case <-b.quitCh:
+				return
+			}
+		case e, ok := <-b.w.Events():
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(b.maxLatency)
+			}
+			batch = append(batch, e)
+			// take the events queued already, then the wrapped watcher is
+			// idle unless more arrived meanwhile
+			for len(batch) < b.maxSize && len(b.w.Events()) > 0 {
+				batch = append(batch, <-b.w.Events())
+			}
+			if len(batch) >= b.maxSize || len(b.w.Events()) == 0 {
+				if !flush() {
+					return
+				}
+			}
+		case <-timerC:
+			if !flush() {
+				return
+			}
+		}
+	}
+}
+
+func (b *Batcher) Batches() <-chan []Event {
+	return b.batches
+}
+
+func (b *Batcher) Errors() <-chan error {
+	return b.errors
+}
+
+func (b *Batcher) Add(root string) error {
+	return b.w.Add(root)
+}
+
+func (b *Batcher) Remove(root string) error {
+	return b.w.Remove(root)
+}
+
+// Close drops a batch that was not delivered yet, Batches() is closed like
+// Events() of a Watcher.
+func (b *Batcher) Close() (err error) {
+	b.closeOnce.Do(func() {
+		close(b.quitCh)
+		err = b.w.Close()
+		<-b.doneCh
+	})
+	return
+}
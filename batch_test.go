@@ -0,0 +1,81 @@
+package panoptes_test
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Batcher", func() {
+
+	var w *fakeWatcher
+
+	BeforeEach(func() {
+		w = newFakeWatcher()
+	})
+
+	events := func(n int) []panoptes.Event {
+		events := make([]panoptes.Event, n)
+		for i := range events {
+			events[i] = panoptes.Event{Path: fmt.Sprintf("/file%d", i), Op: panoptes.Create}
+		}
+		return events
+	}
+
+	It("should split queued events into batches of max size", func() {
+		all := events(25)
+		for _, e := range all {
+			w.events <- e
+		}
+		b := panoptes.NewBatcher(w, 10, time.Minute)
+		defer b.Close()
+
+		Eventually(b.Batches()).Should(Receive(Equal(all[:10])))
+		Eventually(b.Batches()).Should(Receive(Equal(all[10:20])))
+		Eventually(b.Batches()).Should(Receive(Equal(all[20:])))
+		Consistently(b.Batches()).ShouldNot(Receive())
+	})
+
+	It("should flush when no more events are queued", func() {
+		b := panoptes.NewBatcher(w, 10, time.Minute)
+		defer b.Close()
+
+		all := events(2)
+		w.events <- all[0]
+		Eventually(b.Batches()).Should(Receive(Equal(all[:1])))
+		w.events <- all[1]
+		Eventually(b.Batches()).Should(Receive(Equal(all[1:])))
+	})
+
+	It("should keep order across batches while the consumer is slow", func() {
+		b := panoptes.NewBatcher(w, 7, 10*time.Millisecond)
+		defer b.Close()
+
+		all := events(100)
+		go func() {
+			for _, e := range all {
+				w.events <- e
+			}
+		}()
+
+		received := []panoptes.Event{}
+		for len(received) < len(all) {
+			var batch []panoptes.Event
+			Eventually(b.Batches()).Should(Receive(&batch))
+			Expect(len(batch)).To(BeNumerically("<=", 7))
+			received = append(received, batch...)
+			time.Sleep(time.Millisecond)
+		}
+		Expect(received).To(Equal(all))
+	})
+
+	It("should close batches when closed", func() {
+		b := panoptes.NewBatcher(w, 10, time.Minute)
+		Expect(b.Close()).To(Succeed())
+		Eventually(b.Batches()).Should(BeClosed())
+		Eventually(b.Errors()).Should(BeClosed())
+	})
+})
@@ -0,0 +1,13 @@
+// +build go1.20
+
+package panoptes
+
+import (
+	"context"
+)
+
+// contextCause returns why ctx is done, the error given to the cancel
+// function of context.WithCancelCause if there was one.
+func contextCause(ctx context.Context) error {
+	return context.Cause(ctx)
+}
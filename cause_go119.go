@@ -0,0 +1,13 @@
+// +build !go1.20
+
+package panoptes
+
+import (
+	"context"
+)
+
+// contextCause returns why ctx is done. Causes are only known from go 1.20
+// on, ctx.Err() is all there is before.
+func contextCause(ctx context.Context) error {
+	return ctx.Err()
+}
@@ -0,0 +1,80 @@
+package panoptes_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watcher Close", func() {
+	closeSpecs(func(path string) panoptes.Watcher {
+		return newWatcher(path)
+	})
+})
+
+var _ = Describe("PollWatcher Close", func() {
+	closeSpecs(func(path string) panoptes.Watcher {
+		return newPollWatcher(path)
+	})
+})
+
+var _ = Describe("Coalescer Close", func() {
+	closeSpecs(func(path string) panoptes.Watcher {
+		return panoptes.NewCoalescer(newWatcher(path), 10*time.Millisecond)
+	})
+})
+
+// closeConcurrently calls Close from n goroutines at once and returns their
+// errors.
+func closeConcurrently(w panoptes.Watcher, n int) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = w.Close()
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+func closeSpecs(newWatcher func(path string) panoptes.Watcher) {
+
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = sc.NewTest()
+	})
+
+	It("should close its channels before Close returns", func() {
+		w := newWatcher(dir)
+		Expect(w.Close()).To(Succeed())
+		Expect(w.Events()).To(BeClosed())
+		Expect(w.Errors()).To(BeClosed())
+		Expect(w.Close()).To(Succeed())
+	})
+
+	It("should close once when Close is called concurrently while events are not read", func() {
+		w := newWatcher(dir)
+
+		for i := 0; i < 50; i++ {
+			createFile(filepath.Join(dir, fmt.Sprintf("file%d.txt", i)), "ohai")
+		}
+		Eventually(w.Events()).Should(Receive())
+
+		for _, err := range closeConcurrently(w, 10) {
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(w.Errors()).To(BeClosed())
+		for range w.Events() {
+		}
+		Expect(w.Close()).To(Succeed())
+	})
+}
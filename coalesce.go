@@ -0,0 +1,437 @@
+package panoptes
+
+import (
+	"container/heap"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Coalescer wraps a Watcher and holds the changes of each path until the
+// path has been quiet for the coalescing window. It then reports their net
+// effect: Create+Modify is Create, Create+Remove is nothing, a chain of
+// renames is one Rename, attribute changes of a new file are part of its
+// Create. Changes that cannot be folded are reported as they
+// are, in order. Renames of directories move the pending changes of the
+// paths inside them, these are reported after the rename. An Overflow event
+// is reported right after all changes seen before it. Seq numbers the events
+// of the Coalescer itself.
+type Coalescer struct {
+	w         Watcher
+	window    time.Duration
+	state     *coalesceState
+	events    chan Event
+	errors    chan error
+	quitCh    chan error
+	doneCh    chan struct{}
+	closeOnce sync.Once
+	seq       uint64
+}
+
+func NewCoalescer(w Watcher, window time.Duration) *Coalescer {
+	c := &Coalescer{
+		w:      w,
+		window: window,
+		state:  newCoalesceState(),
+		events: make(chan Event, cap(w.Events())),
+		errors: make(chan error),
+		quitCh: make(chan error),
+		doneCh: make(chan struct{}),
+	}
+
+	go c.run()
+
+	return c
+}
+
+func (c *Coalescer) run() {
+	defer func() {
+		close(c.events)
+		close(c.errors)
+		close(c.doneCh)
+	}()
+
+	timer := time.NewTimer(c.window)
+	timer.Stop()
+
+	for {
+		var timerC <-chan time.Time
+		if deadline, ok := c.state.next(); ok {
+			timer.Reset(time.Until(deadline))
+			timerC = timer.C
+		}
+
+		select {
+		case <-c.quitCh:
+			return
+		case err, ok := <-c.w.Errors():
+			if !ok {
+				return
+			}
+			select {
+			case c.errors <- err:
+			case <-c.quitCh:
+				return
+			}
+		case e, ok := <-c.w.Events():
+			if !ok {
+				c.send(c.state.due(time.Now().Add(c.window)))
+				return
+			}
+			c.state.add(e, time.Now().Add(c.window))
+		case <-timerC:
+		}
+		timer.Stop()
+
+		if !c.send(c.state.due(time.Now())) {
+			return
+		}
+	}
+}
+
+func (c *Coalescer) send(events []Event) bool {
+	for _, e := range events {
+		c.seq++
+		e.Seq = c.seq
+		select {
+		case c.events <- e:
+		case <-c.quitCh:
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Coalescer) Events() <-chan Event {
+	return c.events
+}
+
+func (c *Coalescer) Errors() <-chan error {
+	return c.errors
+}
+
+func (c *Coalescer) Add(root string) error {
+	return c.w.Add(root)
+}
+
+func (c *Coalescer) Remove(root string) error {
+	return c.w.Remove(root)
+}
+
+// Close drops the changes that are still pending.
+func (c *Coalescer) Close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.quitCh)
+		err = c.w.Close()
+		<-c.doneCh
+	})
+	return
+}
+
+type pendingChange struct {
+	event    Event
+	modified bool // modified after a rename
+	key      string
+	seq      uint64
+	deadline time.Time
+	index    int // in the deadline queue
+}
+
+// coalesceState folds changes per path. It does not read the clock, callers
+// pass deadlines and the current time, which keeps it deterministic.
+type coalesceState struct {
+	pending map[string]*pendingChange
+	queue   deadlineQueue
+	// the keys of pending by directory, it may hold keys that are no
+	// longer pending until pending is empty
+	paths *pathTree
+	ready []Event
+	seq   uint64
+}
+
+func newCoalesceState() *coalesceState {
+	return &coalesceState{
+		pending: make(map[string]*pendingChange),
+		paths:   newPathTree(),
+	}
+}
+
+func (s *coalesceState) add(e Event, deadline time.Time) {
+	if e.Op == Overflow {
+		// the root is rescanned after it, so all changes seen before go first
+		s.ready = append(s.ready, s.take(append([]*pendingChange(nil), s.queue...))...)
+		s.ready = append(s.ready, e)
+		return
+	}
+
+	if e.Op == Rename && e.IsDir {
+		children := s.detach(e.OldPath)
+		s.fold(e, deadline)
+		s.move(children, e.OldPath, e.Path)
+		return
+	}
+	s.fold(e, deadline)
+}
+
+func (s *coalesceState) fold(e Event, deadline time.Time) {
+	key := e.Path
+	if e.Op == Rename {
+		key = e.OldPath
+	}
+
+	p, ok := s.pending[key]
+	if !ok {
+		if e.Op == Rename {
+			s.flush(e.Path)
+		}
+		s.put(e.Path, &pendingChange{event: e}, deadline)
+		return
+	}
+
+	switch e.Op {
+	case Create:
+		if p.event.Op == Remove && !p.event.IsDir && !e.IsDir {
+			p.event = Event{Path: e.Path, Op: Modify, IsDir: e.IsDir, Root: e.Root, Meta: e.Meta}
+			s.extend(p, deadline)
+			return
+		}
+	case Modify:
+		switch p.event.Op {
+		case Create, Modify:
+			p.event.Meta = e.Meta
+			s.extend(p, deadline)
+			return
+		case Rename:
+			p.event.Meta = e.Meta
+			p.modified = true
+			s.extend(p, deadline)
+			return
+		}
+	case Remove:
+		switch p.event.Op {
+		case Create:
+			s.drop(p)
+			return
+		case Modify, Attrib:
+			p.event = Event{Path: p.event.Path, Op: Remove, IsDir: p.event.IsDir, Root: p.event.Root}
+			s.extend(p, deadline)
+			return
+		case Rename:
+			if _, ok := s.pending[p.event.OldPath]; !ok {
+				s.drop(p)
+				p.event = Event{Path: p.event.OldPath, Op: Remove, IsDir: p.event.IsDir, Root: p.event.Root}
+				p.modified = false
+				s.put(p.event.Path, p, deadline)
+				return
+			}
+		}
+	case Attrib:
+		switch p.event.Op {
+		case Create, Attrib:
+			p.event.Meta = e.Meta
+			s.extend(p, deadline)
+			return
+		}
+	case Rename:
+		if p.event.Op != Remove && p.event.Op != Attrib {
+			s.flush(e.Path)
+			s.drop(p)
+			switch p.event.Op {
+			case Create:
+				p.event.Path = e.Path
+				p.event.Root = e.Root
+			case Modify:
+				p.event = e
+				p.modified = true
+			case Rename:
+				if p.event.OldPath == e.Path {
+					if !p.modified {
+						return
+					}
+					p.event = Event{Path: e.Path, Op: Modify, IsDir: e.IsDir, Root: e.Root}
+					p.modified = false
+				} else {
+					p.event.Path = e.Path
+					p.event.Root = e.Root
+				}
+			}
+			s.put(e.Path, p, deadline)
+			return
+		}
+	}
+
+	// cannot be folded, report what we have and start over
+	s.flush(key)
+	s.put(e.Path, &pendingChange{event: e}, deadline)
+}
+
+func (s *coalesceState) put(key string, p *pendingChange, deadline time.Time) {
+	if p.seq == 0 {
+		s.seq++
+		p.seq = s.seq
+	}
+	p.key = key
+	p.deadline = deadline
+	s.pending[key] = p
+	s.paths.add(key)
+	heap.Push(&s.queue, p)
+}
+
+// extend moves the deadline of the pending change p.
+func (s *coalesceState) extend(p *pendingChange, deadline time.Time) {
+	p.deadline = deadline
+	heap.Fix(&s.queue, p.index)
+}
+
+// drop forgets the pending change p.
+func (s *coalesceState) drop(p *pendingChange) {
+	if s.pending[p.key] != p {
+		return
+	}
+	delete(s.pending, p.key)
+	heap.Remove(&s.queue, p.index)
+	if len(s.pending) == 0 {
+		s.paths = newPathTree()
+	}
+}
+
+// detach removes the pending changes of the paths inside dir and returns
+// them in the order they were seen.
+func (s *coalesceState) detach(dir string) []*pendingChange {
+	var children []*pendingChange
+	for _, pth := range s.paths.under(dir) {
+		if p, ok := s.pending[pth]; ok {
+			children = append(children, p)
+		}
+	}
+	for _, p := range children {
+		s.drop(p)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].seq < children[j].seq
+	})
+	return children
+}
+
+// move puts the changes detached from inside oldDir back under its new path
+// dir. They go out after the rename of dir, the paths they have only exist
+// from then on.
+func (s *coalesceState) move(children []*pendingChange, oldDir, dir string) {
+	var after uint64
+	if p, ok := s.pending[dir]; ok {
+		after = p.seq
+	}
+	for _, p := range children {
+		p.event.Path = dir + p.event.Path[len(oldDir):]
+		if p.event.Op == Rename && isUnder(p.event.OldPath, oldDir) {
+			p.event.OldPath = dir + p.event.OldPath[len(oldDir):]
+		}
+		if p.seq < after {
+			p.seq = 0
+		}
+		key := dir + p.key[len(oldDir):]
+		s.flush(key)
+		s.put(key, p, p.deadline)
+	}
+}
+
+// flush moves the pending change of key to the ready queue.
+func (s *coalesceState) flush(key string) {
+	if p, ok := s.pending[key]; ok {
+		s.ready = append(s.ready, s.take([]*pendingChange{p})...)
+	}
+}
+
+// due returns the ready events followed by the changes whose deadline
+// passed, in the order they were first seen.
+func (s *coalesceState) due(now time.Time) []Event {
+	events := s.ready
+	s.ready = nil
+	var passed []*pendingChange
+	for len(s.queue) > 0 && !s.queue[0].deadline.After(now) {
+		p := s.queue[0]
+		passed = append(passed, p)
+		s.drop(p)
+	}
+	return append(events, s.take(passed)...)
+}
+
+// take removes the pending changes and returns their events in the
+// order they were first seen. The changes of parent directories seen before
+// are taken along, a Create of dir/f never goes out before the one of dir
+// when the deadline of dir was extended.
+func (s *coalesceState) take(changes []*pendingChange) []Event {
+	taken := make(map[*pendingChange]bool)
+	for _, p := range changes {
+		taken[p] = true
+		for pth := p.key; filepath.Dir(pth) != pth; {
+			pth = filepath.Dir(pth)
+			if parent, ok := s.pending[pth]; ok && parent.seq < p.seq {
+				taken[parent] = true
+			}
+		}
+	}
+
+	changes = changes[:0]
+	for p := range taken {
+		changes = append(changes, p)
+		s.drop(p)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].seq < changes[j].seq
+	})
+
+	var events []Event
+	for _, p := range changes {
+		events = append(events, p.events()...)
+	}
+	return events
+}
+
+// next returns the earliest deadline of the pending changes.
+func (s *coalesceState) next() (deadline time.Time, ok bool) {
+	if len(s.ready) > 0 {
+		return time.Time{}, true
+	}
+	if len(s.queue) == 0 {
+		return time.Time{}, false
+	}
+	return s.queue[0].deadline, true
+}
+
+func (p *pendingChange) events() []Event {
+	if p.modified {
+		return []Event{p.event, {Path: p.event.Path, Op: Modify, IsDir: p.event.IsDir, Root: p.event.Root, Meta: p.event.Meta}}
+	}
+	return []Event{p.event}
+}
+
+// deadlineQueue is a heap of pending changes by deadline.
+type deadlineQueue []*pendingChange
+
+func (q deadlineQueue) Len() int { return len(q) }
+
+func (q deadlineQueue) Less(i, j int) bool {
+	return q[i].deadline.Before(q[j].deadline)
+}
+
+func (q deadlineQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *deadlineQueue) Push(x interface{}) {
+	p := x.(*pendingChange)
+	p.index = len(*q)
+	*q = append(*q, p)
+}
+
+func (q *deadlineQueue) Pop() interface{} {
+	old := *q
+	p := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return p
+}
@@ -0,0 +1,187 @@
+package panoptes_test
+
+import (
+	"time"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type fakeWatcher struct {
+	events chan panoptes.Event
+	errors chan error
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{
+		events: make(chan panoptes.Event, 1024),
+		errors: make(chan error),
+	}
+}
+
+func (w *fakeWatcher) Events() <-chan panoptes.Event { return w.events }
+func (w *fakeWatcher) Errors() <-chan error          { return w.errors }
+func (w *fakeWatcher) Add(root string) error         { return nil }
+func (w *fakeWatcher) Remove(root string) error      { return nil }
+func (w *fakeWatcher) Close() error {
+	close(w.events)
+	close(w.errors)
+	return nil
+}
+
+var _ = Describe("Coalescer", func() {
+
+	var w *fakeWatcher
+	var c *panoptes.Coalescer
+	var seq uint64
+
+	BeforeEach(func() {
+		w = newFakeWatcher()
+		c = panoptes.NewCoalescer(w, 50*time.Millisecond)
+		seq = 0
+	})
+
+	AfterEach(func() {
+		Expect(c.Close()).To(Succeed())
+	})
+
+	send := func(events ...panoptes.Event) {
+		for _, e := range events {
+			w.events <- e
+		}
+	}
+
+	expect := func(events ...panoptes.Event) {
+		for _, e := range events {
+			var got panoptes.Event
+			Eventually(c.Events()).Should(Receive(&got))
+			seq++
+			Expect(got.Seq).To(Equal(seq))
+			got.Seq = 0
+			Expect(got).To(Equal(e))
+		}
+		Consistently(c.Events(), 200*time.Millisecond).ShouldNot(Receive())
+	}
+
+	create := panoptes.Event{Path: "/a", Op: panoptes.Create}
+	modify := panoptes.Event{Path: "/a", Op: panoptes.Modify}
+	remove := panoptes.Event{Path: "/a", Op: panoptes.Remove}
+	attrib := panoptes.Event{Path: "/a", Op: panoptes.Attrib}
+
+	It("should fold create and modify into create", func() {
+		send(create, modify, modify)
+		expect(create)
+	})
+
+	It("should drop create followed by remove", func() {
+		send(create, modify, remove)
+		expect()
+	})
+
+	It("should report the changes seen before an overflow first", func() {
+		overflow := panoptes.Event{Path: "/", Op: panoptes.Overflow, IsDir: true, Root: "/"}
+		other := panoptes.Event{Path: "/b", Op: panoptes.Modify}
+		send(create, overflow, other)
+		expect(create, overflow, other)
+	})
+
+	It("should fold modify and remove into remove", func() {
+		send(modify, remove)
+		expect(remove)
+	})
+
+	It("should fold attribute changes of new files into create", func() {
+		send(create, attrib, attrib)
+		expect(create)
+	})
+
+	It("should fold attribute changes and remove into remove", func() {
+		send(attrib, attrib, remove)
+		expect(remove)
+	})
+
+	It("should fold remove and create into modify", func() {
+		send(remove, create)
+		expect(modify)
+	})
+
+	It("should fold rename chains", func() {
+		send(
+			panoptes.Event{Path: "/b", OldPath: "/a", Op: panoptes.Rename},
+			panoptes.Event{Path: "/c", OldPath: "/b", Op: panoptes.Rename},
+		)
+		expect(panoptes.Event{Path: "/c", OldPath: "/a", Op: panoptes.Rename})
+	})
+
+	It("should drop a rename that is undone", func() {
+		send(
+			panoptes.Event{Path: "/b", OldPath: "/a", Op: panoptes.Rename},
+			panoptes.Event{Path: "/a", OldPath: "/b", Op: panoptes.Rename},
+		)
+		expect()
+	})
+
+	It("should report a created and renamed file as created", func() {
+		send(create, panoptes.Event{Path: "/b", OldPath: "/a", Op: panoptes.Rename})
+		expect(panoptes.Event{Path: "/b", Op: panoptes.Create})
+	})
+
+	It("should keep modifications of renamed files", func() {
+		send(modify, panoptes.Event{Path: "/b", OldPath: "/a", Op: panoptes.Rename})
+		expect(
+			panoptes.Event{Path: "/b", OldPath: "/a", Op: panoptes.Rename},
+			panoptes.Event{Path: "/b", Op: panoptes.Modify},
+		)
+	})
+
+	It("should report a renamed and removed file as removed", func() {
+		send(panoptes.Event{Path: "/b", OldPath: "/a", Op: panoptes.Rename}, panoptes.Event{Path: "/b", Op: panoptes.Remove})
+		expect(remove)
+	})
+
+	It("should report events of different paths in order", func() {
+		send(
+			panoptes.Event{Path: "/c", Op: panoptes.Create},
+			panoptes.Event{Path: "/b", Op: panoptes.Modify},
+			create,
+			panoptes.Event{Path: "/b", Op: panoptes.Modify},
+		)
+		expect(
+			panoptes.Event{Path: "/c", Op: panoptes.Create},
+			panoptes.Event{Path: "/b", Op: panoptes.Modify},
+			create,
+		)
+	})
+
+	It("should report a new folder before the files created in it", func() {
+		dir := panoptes.Event{Path: "/d", Op: panoptes.Create, IsDir: true}
+		file := panoptes.Event{Path: "/d/f", Op: panoptes.Create}
+		send(dir, file)
+		// the folder stays pending after the file is due
+		time.Sleep(30 * time.Millisecond)
+		send(panoptes.Event{Path: "/d", Op: panoptes.Attrib, IsDir: true})
+		expect(dir, file)
+	})
+
+	It("should move the changes in a renamed folder along", func() {
+		send(
+			panoptes.Event{Path: "/d/f", Op: panoptes.Create},
+			panoptes.Event{Path: "/d/g", Op: panoptes.Rename, OldPath: "/d/h"},
+			panoptes.Event{Path: "/e", Op: panoptes.Rename, OldPath: "/d", IsDir: true},
+		)
+		expect(
+			panoptes.Event{Path: "/e", Op: panoptes.Rename, OldPath: "/d", IsDir: true},
+			panoptes.Event{Path: "/e/f", Op: panoptes.Create},
+			panoptes.Event{Path: "/e/g", Op: panoptes.Rename, OldPath: "/e/h"},
+		)
+	})
+
+	It("should wait until the path is quiet", func() {
+		for i := 0; i < 5; i++ {
+			send(modify)
+			Consistently(c.Events(), 20*time.Millisecond).ShouldNot(Receive())
+		}
+		expect(modify)
+	})
+})
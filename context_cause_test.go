@@ -0,0 +1,31 @@
+// +build go1.20
+
+package panoptes_test
+
+import (
+	"context"
+	"errors"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watcher with a cancel cause", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = sc.NewTest()
+	})
+
+	It("should return the cause of the cancellation", func() {
+		cause := errors.New("shutting down")
+		ctx, cancel := context.WithCancelCause(context.Background())
+		w, err := panoptes.NewPollWatcherContext(ctx, dir)
+		Expect(err).NotTo(HaveOccurred())
+
+		cancel(cause)
+		Expect(w.Wait()).To(Equal(cause))
+	})
+})
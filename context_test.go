@@ -0,0 +1,86 @@
+package panoptes_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"runtime"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type contextWatcher interface {
+	panoptes.Watcher
+	Done() <-chan struct{}
+	Err() error
+	Wait() error
+}
+
+var _ = Describe("Watcher with context", func() {
+	contextSpecs(func(ctx context.Context, path string, opts ...panoptes.Option) (contextWatcher, error) {
+		return panoptes.NewWatcherContext(ctx, path, opts...)
+	}, runtime.GOOS == "linux")
+})
+
+var _ = Describe("PollWatcher with context", func() {
+	contextSpecs(func(ctx context.Context, path string, opts ...panoptes.Option) (contextWatcher, error) {
+		return panoptes.NewPollWatcherContext(ctx, path, opts...)
+	}, true)
+})
+
+// contextSpecs tests a constructor, walks tells whether it walks the tree
+// before it returns.
+func contextSpecs(newWatcher func(ctx context.Context, path string, opts ...panoptes.Option) (contextWatcher, error), walks bool) {
+
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = sc.NewTest()
+	})
+
+	It("should close when its context is cancelled", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		w, err := newWatcher(ctx, dir)
+		Expect(err).NotTo(HaveOccurred())
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- w.Wait()
+		}()
+		Consistently(w.Done()).ShouldNot(BeClosed())
+		Expect(w.Err()).To(BeNil())
+
+		cancel()
+		Eventually(errc).Should(Receive(Equal(context.Canceled)))
+		Expect(w.Done()).To(BeClosed())
+		Expect(w.Err()).To(Equal(context.Canceled))
+		Eventually(w.Events()).Should(BeClosed())
+		Eventually(w.Errors()).Should(BeClosed())
+		Expect(w.Close()).To(Succeed())
+	})
+
+	It("should not fail after Close", func() {
+		w, err := newWatcher(context.Background(), dir)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(w.Close()).To(Succeed())
+		Expect(w.Wait()).To(Succeed())
+		Expect(w.Close()).To(Succeed())
+	})
+
+	It("should stop the initial walk when the context is cancelled", func() {
+		if !walks {
+			Skip("no walk before the constructor returns")
+		}
+		for i := 0; i < 10; i++ {
+			mkdir(filepath.Join(dir, string(rune('a'+i))))
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, err := newWatcher(ctx, dir)
+		Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+	})
+}
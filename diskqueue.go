@@ -0,0 +1,420 @@
+package panoptes
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// DefaultSegmentSize is the size of a DiskQueue segment file after which
+// the next one is started.
+const DefaultSegmentSize = 16 << 20
+
+// diskQueueMemory is how many events a DiskQueue keeps in memory for a
+// consumer that keeps up, if more are waiting they are read back from the
+// segment files.
+const diskQueueMemory = DefaultEventBufferSize
+
+// DiskQueue wraps a Watcher and writes its events to segment files in dir
+// before it delivers them, so a consumer that falls behind never makes the
+// watcher block or drop events. Events are kept until they are acknowledged
+// with Ack: a DiskQueue created later on the same dir first delivers the
+// ones that were not, in order. Events are synced to disk at the end of
+// every burst read from the watcher and before they are delivered, so a
+// crash loses at most the events of a burst still being read, never one the
+// consumer received. Events the wrapped watcher still holds are lost with
+// it, so are the ones Close drains after a write failed. Events that were
+// delivered but not acknowledged may be delivered again. Seq numbers the
+// events of the queue across restarts.
+type DiskQueue struct {
+	w           Watcher
+	dir         string
+	segmentSize int64
+	events      chan Event
+	errors      chan error
+	quitCh      chan error
+	doneCh      chan struct{}
+	closeOnce   sync.Once
+
+	lock     sync.Mutex
+	segments []uint64 // Seq of the first event of each segment file
+	writer   *segmentWriter
+	reader   *segmentReader
+	seq      uint64 // last written
+	synced   uint64 // last synced to disk, only these are delivered
+	sent     uint64 // last delivered
+	acked    uint64 // last acknowledged
+	// the events after sent while they fit, otherwise they are read from
+	// the segment files until the consumer caught up
+	memory  []Event
+	spilled bool
+	next    *Event // the event after sent once it was read
+}
+
+// NewDiskQueue wraps w, creating dir if needed. Segment files are started
+// every segmentSize bytes, DefaultSegmentSize if it is not positive. w is
+// left open if it fails.
+func NewDiskQueue(w Watcher, dir string, segmentSize int64) (*DiskQueue, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	acked, err := readAcked(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &DiskQueue{
+		w:           w,
+		dir:         dir,
+		segmentSize: segmentSize,
+		events:      make(chan Event),
+		errors:      make(chan error),
+		quitCh:      make(chan error),
+		doneCh:      make(chan struct{}),
+		segments:    segments,
+		seq:         acked,
+		acked:       acked,
+	}
+	if n := len(segments); n > 0 {
+		last, err := lastSeq(dir, segments[n-1])
+		if err != nil {
+			return nil, err
+		}
+		if last > q.seq {
+			q.seq = last
+		}
+	}
+	q.synced = q.seq
+	q.sent = acked
+	q.spilled = q.sent < q.seq
+	if err := q.removeAcked(); err != nil {
+		return nil, err
+	}
+
+	go q.run()
+
+	return q, nil
+}
+
+func (q *DiskQueue) run() {
+	defer func() {
+		q.lock.Lock()
+		q.closeReader()
+		if q.writer != nil {
+			q.writer.close()
+			q.writer = nil
+		}
+		q.lock.Unlock()
+		close(q.events)
+		close(q.errors)
+		close(q.doneCh)
+	}()
+
+	in, inErrors := q.w.Events(), q.w.Errors()
+	var errs []error
+
+	for {
+		q.lock.Lock()
+		next, ok, err := q.peek()
+		q.lock.Unlock()
+		if err != nil {
+			q.fail(err)
+			return
+		}
+		if in == nil && !ok && len(errs) == 0 {
+			return
+		}
+
+		var out chan Event
+		if ok {
+			out = q.events
+		}
+		var errOut chan error
+		var firstErr error
+		if len(errs) > 0 {
+			errOut = q.errors
+			firstErr = errs[0]
+		}
+
+		select {
+		case <-q.quitCh:
+			if in != nil {
+				q.drain(in)
+			}
+			return
+		case e, ok := <-in:
+			if !ok {
+				in = nil
+				inErrors = nil
+				err = q.locked(q.sync)
+			} else {
+				err = q.locked(func() error {
+					if err := q.write(e); err != nil {
+						return err
+					}
+					if len(in) == 0 {
+						return q.sync()
+					}
+					return nil
+				})
+			}
+			if err != nil {
+				q.fail(err)
+				return
+			}
+		case err, ok := <-inErrors:
+			if !ok {
+				inErrors = nil
+				break
+			}
+			errs = append(errs, err)
+		case out <- next:
+			q.lock.Lock()
+			q.delivered(next)
+			q.lock.Unlock()
+		case errOut <- firstErr:
+			errs = errs[1:]
+		}
+	}
+}
+
+// drain writes the events the wrapped watcher delivers while it is closed,
+// the next DiskQueue on dir delivers them.
+func (q *DiskQueue) drain(in <-chan Event) {
+	var err error
+	for e := range in {
+		if err == nil {
+			err = q.locked(func() error { return q.write(e) })
+		}
+	}
+	if err == nil {
+		q.locked(q.sync)
+	}
+}
+
+func (q *DiskQueue) locked(f func() error) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return f()
+}
+
+// fail reports err unless the queue is closed meanwhile.
+func (q *DiskQueue) fail(err error) {
+	select {
+	case q.errors <- &QueueError{Dir: q.dir, Err: err}:
+	case <-q.quitCh:
+	}
+}
+
+// write appends e to the segment being written, starting a new one when it
+// is full.
+func (q *DiskQueue) write(e Event) error {
+	if q.writer == nil || q.writer.size >= q.segmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+	e.Seq = q.seq + 1
+	if err := q.writer.write(e); err != nil {
+		return err
+	}
+	q.seq = e.Seq
+	if !q.spilled {
+		if len(q.memory) < diskQueueMemory {
+			q.memory = append(q.memory, e)
+		} else {
+			q.spilled = true
+			q.memory = nil
+		}
+	}
+	return nil
+}
+
+func (q *DiskQueue) rotate() error {
+	if q.writer != nil {
+		err := q.writer.close()
+		q.writer = nil
+		if err != nil {
+			return err
+		}
+		q.synced = q.seq
+	}
+	first := q.seq + 1
+	w, err := createSegment(segmentPath(q.dir, first))
+	if err != nil {
+		return err
+	}
+	q.writer = w
+	// a segment without events may be left from before a crash
+	if n := len(q.segments); n == 0 || q.segments[n-1] != first {
+		q.segments = append(q.segments, first)
+	}
+	return nil
+}
+
+func (q *DiskQueue) sync() error {
+	if q.writer == nil || q.synced == q.seq {
+		return nil
+	}
+	if err := q.writer.sync(); err != nil {
+		return err
+	}
+	q.synced = q.seq
+	return nil
+}
+
+// peek returns the event after sent if it was synced to disk. A consumer
+// that caught up in the middle of a burst gets the events written so far
+// after one sync, the events written meanwhile share the next.
+func (q *DiskQueue) peek() (Event, bool, error) {
+	if q.next != nil {
+		return *q.next, true, nil
+	}
+	if q.sent == q.synced {
+		if err := q.sync(); err != nil {
+			return Event{}, false, err
+		}
+	}
+	if q.sent == q.synced {
+		if q.spilled && q.sent == q.seq {
+			// caught up, new events are kept in memory again
+			q.spilled = false
+			q.closeReader()
+		}
+		return Event{}, false, nil
+	}
+	e := Event{}
+	if q.spilled {
+		var err error
+		if e, err = q.read(q.sent + 1); err != nil {
+			return Event{}, false, err
+		}
+	} else {
+		e = q.memory[0]
+	}
+	q.next = &e
+	return e, true, nil
+}
+
+func (q *DiskQueue) delivered(e Event) {
+	q.sent = e.Seq
+	q.next = nil
+	if len(q.memory) > 0 && q.memory[0].Seq == e.Seq {
+		q.memory[0] = Event{}
+		q.memory = q.memory[1:]
+		if len(q.memory) == 0 {
+			q.memory = nil
+		}
+	}
+}
+
+// read returns the event seq from the segment files, continuing where the
+// last read stopped if it can.
+func (q *DiskQueue) read(seq uint64) (Event, error) {
+	if q.reader != nil {
+		e, err := q.reader.read()
+		if err == nil && e.Seq == seq {
+			return e, nil
+		}
+		// the segment ended, maybe with a record torn by a crash
+		q.closeReader()
+	}
+
+	i := sort.Search(len(q.segments), func(i int) bool {
+		return q.segments[i] > seq
+	}) - 1
+	if i < 0 {
+		return Event{}, fmt.Errorf("Event %d is missing", seq)
+	}
+	r, err := openSegment(q.dir, q.segments[i])
+	if err != nil {
+		return Event{}, err
+	}
+	for {
+		e, err := r.read()
+		if err != nil || e.Seq > seq {
+			r.close()
+			return Event{}, fmt.Errorf("Event %d is missing", seq)
+		}
+		if e.Seq == seq {
+			q.reader = r
+			return e, nil
+		}
+	}
+}
+
+func (q *DiskQueue) closeReader() {
+	if q.reader != nil {
+		q.reader.close()
+		q.reader = nil
+	}
+}
+
+// removeAcked removes the segment files that hold only acknowledged events,
+// except the last one.
+func (q *DiskQueue) removeAcked() error {
+	for len(q.segments) > 1 && q.segments[1] <= q.acked+1 {
+		if q.reader != nil && q.reader.first == q.segments[0] {
+			q.closeReader()
+		}
+		if err := os.Remove(segmentPath(q.dir, q.segments[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		q.segments = q.segments[1:]
+	}
+	return nil
+}
+
+// Ack acknowledges the events up to seq. They are not delivered again by a
+// later DiskQueue on the same dir and their segment files are removed.
+// Events not delivered yet cannot be acknowledged.
+func (q *DiskQueue) Ack(seq uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if seq > q.sent {
+		seq = q.sent
+	}
+	if seq <= q.acked {
+		return nil
+	}
+	if err := writeAcked(q.dir, seq); err != nil {
+		return err
+	}
+	q.acked = seq
+	return q.removeAcked()
+}
+
+func (q *DiskQueue) Events() <-chan Event {
+	return q.events
+}
+
+func (q *DiskQueue) Errors() <-chan error {
+	return q.errors
+}
+
+func (q *DiskQueue) Add(root string) error {
+	return q.w.Add(root)
+}
+
+func (q *DiskQueue) Remove(root string) error {
+	return q.w.Remove(root)
+}
+
+// Close writes the events the wrapped watcher still had to the segment
+// files, the next DiskQueue on dir delivers them.
+func (q *DiskQueue) Close() (err error) {
+	q.closeOnce.Do(func() {
+		close(q.quitCh)
+		err = q.w.Close()
+		<-q.doneCh
+	})
+	return
+}
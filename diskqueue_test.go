@@ -0,0 +1,159 @@
+package panoptes_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DiskQueue", func() {
+
+	var w *fakeWatcher
+	var dir string
+
+	BeforeEach(func() {
+		w = newFakeWatcher()
+		var err error
+		dir, err = ioutil.TempDir("", "panoptes-queue")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	event := func(i int) panoptes.Event {
+		return panoptes.Event{Path: fmt.Sprintf("/file%d", i), Op: panoptes.Create}
+	}
+
+	send := func(w *fakeWatcher, from, to int) {
+		for i := from; i < to; i++ {
+			w.events <- event(i)
+		}
+	}
+
+	// expect receives the events from to to, numbered from seq on.
+	expect := func(q *panoptes.DiskQueue, from, to int, seq uint64) {
+		for i := from; i < to; i++ {
+			var got panoptes.Event
+			select {
+			case got = <-q.Events():
+			case <-time.After(10 * time.Second):
+				Fail(fmt.Sprintf("event %d was not delivered", i))
+			}
+			Expect(got.Seq).To(Equal(seq))
+			got.Seq = 0
+			Expect(got).To(Equal(event(i)))
+			seq++
+		}
+	}
+
+	segments := func() []string {
+		files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+		Expect(err).NotTo(HaveOccurred())
+		return files
+	}
+
+	It("should deliver events in order", func() {
+		q, err := panoptes.NewDiskQueue(w, dir, 0)
+		Expect(err).NotTo(HaveOccurred())
+		defer q.Close()
+
+		send(w, 0, 10)
+		expect(q, 0, 10, 1)
+		Consistently(q.Events()).ShouldNot(Receive())
+	})
+
+	It("should spill to segment files while the consumer is behind", func() {
+		q, err := panoptes.NewDiskQueue(w, dir, 4096)
+		Expect(err).NotTo(HaveOccurred())
+		defer q.Close()
+
+		n := 3 * panoptes.DefaultEventBufferSize
+		sent := make(chan struct{})
+		go func() {
+			defer close(sent)
+			send(w, 0, n)
+		}()
+		Eventually(sent).Should(BeClosed())
+		Eventually(func() int { return len(w.events) }).Should(BeZero())
+		Expect(len(segments())).To(BeNumerically(">", 1))
+
+		expect(q, 0, n, 1)
+		Expect(q.Ack(uint64(n))).To(Succeed())
+		Expect(segments()).To(HaveLen(1))
+	})
+
+	It("should deliver events that were not acknowledged after a restart", func() {
+		q, err := panoptes.NewDiskQueue(w, dir, 1024)
+		Expect(err).NotTo(HaveOccurred())
+		send(w, 0, 20)
+		expect(q, 0, 10, 1)
+		Expect(q.Ack(5)).To(Succeed())
+		Expect(q.Close()).To(Succeed())
+
+		w = newFakeWatcher()
+		q, err = panoptes.NewDiskQueue(w, dir, 1024)
+		Expect(err).NotTo(HaveOccurred())
+		defer q.Close()
+		expect(q, 5, 20, 6)
+		send(w, 20, 25)
+		expect(q, 20, 25, 21)
+	})
+
+	It("should keep the events of the watcher it is closed with", func() {
+		q, err := panoptes.NewDiskQueue(w, dir, 0)
+		Expect(err).NotTo(HaveOccurred())
+		send(w, 0, 10)
+		Expect(q.Close()).To(Succeed())
+		Expect(q.Events()).To(BeClosed())
+
+		w = newFakeWatcher()
+		q, err = panoptes.NewDiskQueue(w, dir, 0)
+		Expect(err).NotTo(HaveOccurred())
+		defer q.Close()
+		expect(q, 0, 10, 1)
+	})
+
+	It("should skip a record torn by a crash", func() {
+		q, err := panoptes.NewDiskQueue(w, dir, 0)
+		Expect(err).NotTo(HaveOccurred())
+		send(w, 0, 5)
+		expect(q, 0, 5, 1)
+		Expect(q.Close()).To(Succeed())
+
+		files := segments()
+		Expect(files).To(HaveLen(1))
+		f, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.Write([]byte{42, 1, 2, 3})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		w = newFakeWatcher()
+		q, err = panoptes.NewDiskQueue(w, dir, 0)
+		Expect(err).NotTo(HaveOccurred())
+		defer q.Close()
+		expect(q, 0, 5, 1)
+		send(w, 5, 10)
+		expect(q, 5, 10, 6)
+	})
+
+	It("should forward the errors of the watcher", func() {
+		q, err := panoptes.NewDiskQueue(w, dir, 0)
+		Expect(err).NotTo(HaveOccurred())
+		defer q.Close()
+
+		overflow := &panoptes.OverflowError{Root: "/"}
+		go func() {
+			w.errors <- overflow
+		}()
+		Eventually(q.Errors()).Should(Receive(Equal(overflow)))
+	})
+})
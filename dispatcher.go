@@ -0,0 +1,639 @@
+package panoptes
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+)
+
+// dispatcher delivers translated events and errors to the consumer. Every
+// backend embeds one.
+type dispatcher struct {
+	events chan Event
+	errors chan error
+	quitCh chan error
+	roots  *roots
+	opts   *options
+	index  *treeIndex
+	hashes *contentHashes
+	// deliveries waiting for the content hashes, see hashEvents
+	hashQueue chan delivery
+	hashOnce  sync.Once
+
+	ignoresLock sync.Mutex
+	ignores     map[string]*gitignore
+	// onIgnoreChange is called after the rules of dir changed.
+	onIgnoreChange func(root, dir string)
+
+	replayLock sync.Mutex
+	replayDone *sync.Cond
+	// number of roots whose offline changes are being delivered
+	replays int
+	// trees loaded from the state file, by root, until the root is added
+	saved map[string]*Snapshot
+
+	// sendLock serializes sends so that Seq follows the channel order
+	sendLock sync.Mutex
+	seq      uint64
+	// events that did not fit into Events(), drain sends them in order and
+	// new events queue behind them meanwhile
+	backlog  []Event
+	draining bool
+
+	// backpressure counters, see Stats
+	countLock sync.Mutex
+	blocked   int
+	dropped   int
+	spilled   int
+	queued    int
+
+	ctx       context.Context
+	stopCh    chan struct{} // closed when the backend stopped by itself
+	doneCh    chan struct{} // closed when Close is done
+	closeOnce sync.Once
+	errLock   sync.Mutex
+	err       error
+
+	// goroutines Close waits for, none are started once closing is set
+	goLock     sync.Mutex
+	goroutines sync.WaitGroup
+	closing    bool
+	// the goroutine of supervise, which may be the one calling Close
+	supervisor chan struct{}
+	selfClose  bool
+}
+
+func newDispatcher(ctx context.Context, o *options) dispatcher {
+	var index *treeIndex
+	if o.rescan || o.stateFile != "" || o.metadata {
+		index = newTreeIndex()
+	}
+	var hashes *contentHashes
+	var hashQueue chan delivery
+	if o.contentHash {
+		hashes = newContentHashes(o.hashMaxSize)
+		hashQueue = make(chan delivery, o.eventBufferSize)
+	}
+	return dispatcher{
+		events:    make(chan Event, o.eventBufferSize),
+		errors:    make(chan error),
+		quitCh:    make(chan error),
+		roots:     newRoots(),
+		opts:      o,
+		ignores:   make(map[string]*gitignore),
+		index:     index,
+		hashes:    hashes,
+		hashQueue: hashQueue,
+		saved:     make(map[string]*Snapshot),
+		ctx:       ctx,
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+}
+
+type delivery struct {
+	e    Event
+	live bool
+}
+
+// supervise closes the watcher with its Close when the context is done or
+// the backend stopped.
+func (d *dispatcher) supervise(stop func() error) {
+	d.supervisor = make(chan struct{})
+	go func() {
+		defer close(d.supervisor)
+		var err error
+		select {
+		case <-d.ctx.Done():
+			err = contextCause(d.ctx)
+		case <-d.stopCh:
+		case <-d.quitCh:
+			return
+		}
+
+		d.goLock.Lock()
+		if d.closing {
+			// closed meanwhile
+			d.goLock.Unlock()
+			return
+		}
+		d.selfClose = true
+		d.goLock.Unlock()
+		if err != nil {
+			d.fail(err)
+		}
+		stop()
+	}()
+}
+
+// spawn runs f in a goroutine that Close waits for. It reports false and
+// does not run f once the watcher is closing.
+func (d *dispatcher) spawn(f func()) bool {
+	d.goLock.Lock()
+	defer d.goLock.Unlock()
+	if d.closing {
+		return false
+	}
+	d.goroutines.Add(1)
+	go func() {
+		defer d.goroutines.Done()
+		f()
+	}()
+	return true
+}
+
+// shutdown implements Close: it unblocks the goroutines, stops the backend
+// with stop, waits until all goroutines exited, closes Events() and
+// Errors() and saves the state. Concurrent calls wait for the first one,
+// later calls return nil.
+func (d *dispatcher) shutdown(stop func() error) (err error) {
+	d.closeOnce.Do(func() {
+		d.goLock.Lock()
+		d.closing = true
+		d.goLock.Unlock()
+
+		close(d.quitCh)
+		err = stop()
+		d.goroutines.Wait()
+		close(d.events)
+		close(d.errors)
+		d.goLock.Lock()
+		wait := d.supervisor != nil && !d.selfClose
+		d.goLock.Unlock()
+		if wait {
+			<-d.supervisor
+		}
+		if serr := d.saveState(); err == nil {
+			err = serr
+		}
+		close(d.doneCh)
+	})
+	return
+}
+
+// fail records why the watcher stopped, the first reason is kept.
+func (d *dispatcher) fail(err error) {
+	d.errLock.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.errLock.Unlock()
+}
+
+// cancelled returns why a walk of a tree has to stop early: the context is
+// done or the watcher is closed.
+func (d *dispatcher) cancelled() error {
+	if d.ctx.Err() != nil {
+		return contextCause(d.ctx)
+	}
+	select {
+	case <-d.quitCh:
+		return WatcherClosedErr
+	default:
+		return nil
+	}
+}
+
+// Done is closed when the watcher stopped, after Close, the cancellation
+// of its context or when its backend failed.
+func (d *dispatcher) Done() <-chan struct{} {
+	return d.doneCh
+}
+
+// Err returns why the watcher stopped: the cause of the cancellation of its
+// context, or a BackendError. It is nil while the watcher runs and after
+// Close.
+func (d *dispatcher) Err() error {
+	d.errLock.Lock()
+	defer d.errLock.Unlock()
+	return d.err
+}
+
+// Wait blocks until the watcher stopped and returns Err, it fits
+// errgroup.Group.Go.
+func (d *dispatcher) Wait() error {
+	<-d.doneCh
+	return d.Err()
+}
+
+// emit sends the live event e to the consumer. Events outside of all
+// watched roots are dropped; they can still arrive for a short while after
+// Remove. Events for filtered paths are dropped too, renames across the
+// filter boundary become Create or Remove.
+func (d *dispatcher) emit(e Event) {
+	d.deliver(e, true)
+}
+
+// deliver sends e to the consumer and reports false if the watcher was
+// closed meanwhile. Live events wait until the offline changes of all roots
+// were delivered and are dropped if the index of a rescan or the state
+// file already reflects them.
+// Synthetic events, from rescans and the state file, come from the index.
+func (d *dispatcher) deliver(e Event, live bool) bool {
+	if e.Root == "" {
+		e.Root = d.roots.rootOf(e.Path)
+		if e.Root == "" {
+			return true
+		}
+	}
+	if d.opts.gitignore {
+		d.reloadIgnores(e)
+	}
+	if !d.opts.filter.empty() || d.opts.gitignore {
+		allowed := d.allowed(e.Root, e.Path, e.IsDir)
+		if e.Op == Rename {
+			oldAllowed := d.allowed(e.Root, e.OldPath, e.IsDir)
+			switch {
+			case !allowed && !oldAllowed:
+				return true
+			case !allowed:
+				e = Event{Path: e.OldPath, Op: Remove, IsDir: e.IsDir, Root: e.Root}
+			case !oldAllowed:
+				e = Event{Path: e.Path, Op: Create, IsDir: e.IsDir, Root: e.Root}
+			}
+		} else if !allowed {
+			return true
+		}
+	}
+	if d.opts.metadata && e.Op != Remove {
+		e.Meta = newMetadata(e.Path)
+	}
+	if live {
+		d.waitReplays()
+	}
+	if d.hashQueue != nil {
+		d.hashOnce.Do(func() { d.spawn(d.hashEvents) })
+		select {
+		case d.hashQueue <- delivery{e: e, live: live}:
+			return true
+		case <-d.quitCh:
+			return false
+		}
+	}
+	return d.dispatch(e, live)
+}
+
+// hashEvents dispatches the queued deliveries, hashing a large file holds
+// up the events after it but not the backend.
+func (d *dispatcher) hashEvents() {
+	for {
+		select {
+		case q := <-d.hashQueue:
+			if !d.dispatch(q.e, q.live) {
+				return
+			}
+		case <-d.quitCh:
+			return
+		}
+	}
+}
+
+// dispatch is the part of deliver that uses the index and the content
+// hashes, deliveries pass it in order.
+func (d *dispatcher) dispatch(e Event, live bool) bool {
+	if live && d.index != nil {
+		// only scans make events known, the index kept for WithMetadata
+		// alone must not drop any
+		if (d.opts.rescan || d.opts.stateFile != "") && d.index.known(e) {
+			return true
+		}
+		if d.opts.metadata && e.Op == Attrib {
+			if entry, ok := d.index.entry(e.Root, e.Path); ok {
+				e.OldMeta = entryMetadata(entry)
+			}
+		}
+	}
+	if d.hashes != nil && !d.hashes.update(e) {
+		// the consumer need not know, the index must
+		d.record(e)
+		return true
+	}
+
+	d.sendLock.Lock()
+	defer d.sendLock.Unlock()
+	return d.send(e)
+}
+
+// send passes e to the consumer, or if Events() is full, handles it
+// according to the backpressure policy. sendLock must be held.
+func (d *dispatcher) send(e Event) bool {
+	if !d.draining {
+		e.Seq = d.seq + 1
+		select {
+		case d.events <- e:
+			d.seq = e.Seq
+			d.record(e)
+			return true
+		default:
+		}
+	}
+
+	switch d.opts.backpressure {
+	case BackpressureDrop:
+		d.count(&d.dropped, 1)
+		for _, m := range d.backlog {
+			if m.Root == e.Root {
+				return true
+			}
+		}
+		e = Event{Path: e.Root, Op: Overflow, IsDir: true, Root: e.Root}
+	case BackpressureSpill:
+		d.count(&d.spilled, 1)
+	default:
+		d.count(&d.blocked, 1)
+		select {
+		case d.events <- e:
+			d.seq = e.Seq
+			d.record(e)
+			return true
+		case <-d.quitCh:
+			return false
+		}
+	}
+
+	d.seq++
+	e.Seq = d.seq
+	d.backlog = append(d.backlog, e)
+	d.count(&d.queued, 1)
+	if !d.draining {
+		d.draining = d.spawn(d.drain)
+	}
+	return true
+}
+
+// drain sends the backlog to the consumer until it is empty.
+func (d *dispatcher) drain() {
+	for {
+		d.sendLock.Lock()
+		if len(d.backlog) == 0 {
+			d.backlog = nil
+			d.draining = false
+			d.sendLock.Unlock()
+			return
+		}
+		e := d.backlog[0]
+		d.backlog[0] = Event{}
+		d.backlog = d.backlog[1:]
+		d.sendLock.Unlock()
+
+		select {
+		case d.events <- e:
+			d.count(&d.queued, -1)
+			d.record(e)
+		case <-d.quitCh:
+			return
+		}
+	}
+}
+
+// record updates the index with e once the consumer has it, the state file
+// then never holds a change that was not delivered.
+func (d *dispatcher) record(e Event) {
+	if d.index != nil && e.Op != Overflow {
+		d.index.update(e)
+	}
+}
+
+func (d *dispatcher) count(counter *int, n int) {
+	d.countLock.Lock()
+	*counter += n
+	d.countLock.Unlock()
+}
+
+// stats returns the backpressure counters, backends add their own state.
+func (d *dispatcher) stats() Stats {
+	d.countLock.Lock()
+	defer d.countLock.Unlock()
+	return Stats{
+		Blocked: d.blocked,
+		Dropped: d.dropped,
+		Spilled: d.spilled,
+		Backlog: d.queued,
+	}
+}
+
+// watchRoot installs the watches of root with install and records its tree
+// when an index is kept. install may return the tree it saw, otherwise root
+// is scanned after it. If the state file has a tree of root, the changes
+// made since it was saved are delivered before any live event.
+func (d *dispatcher) watchRoot(root string, install func() (*Snapshot, error)) error {
+	d.replayLock.Lock()
+	saved := d.saved[root]
+	delete(d.saved, root)
+	if saved != nil {
+		d.replays++
+	}
+	d.replayLock.Unlock()
+
+	snapshot, err := install()
+	if err != nil {
+		if saved != nil {
+			d.replayed()
+		}
+		return err
+	}
+	if d.index == nil {
+		return nil
+	}
+	if snapshot == nil {
+		if snapshot, err = scanTree(d, root); err != nil {
+			if saved != nil {
+				d.replayed()
+			}
+			return nil
+		}
+	}
+	d.index.set(root, snapshot)
+	if saved == nil {
+		return nil
+	}
+
+	events := Diff(saved, snapshot)
+	replay := func() {
+		defer d.replayed()
+		for _, e := range events {
+			e.Offline = true
+			if !d.deliver(e, false) {
+				// closed before all were delivered, the next watcher
+				// replays them again
+				d.index.set(root, saved)
+				return
+			}
+		}
+	}
+	if !d.spawn(replay) {
+		d.replayed()
+	}
+	return nil
+}
+
+func (d *dispatcher) replayed() {
+	d.replayLock.Lock()
+	d.replays--
+	if d.replays == 0 && d.replayDone != nil {
+		d.replayDone.Broadcast()
+	}
+	d.replayLock.Unlock()
+}
+
+func (d *dispatcher) waitReplays() {
+	d.replayLock.Lock()
+	if d.replayDone == nil {
+		d.replayDone = sync.NewCond(&d.replayLock)
+	}
+	for d.replays > 0 {
+		d.replayDone.Wait()
+	}
+	d.replayLock.Unlock()
+}
+
+func (d *dispatcher) unindexRoot(root string) {
+	if d.index != nil {
+		d.index.remove(root)
+	}
+}
+
+// overflow reports that events under root were lost and brings the consumer
+// back in sync when rescans are enabled.
+func (d *dispatcher) overflow(root string) {
+	d.report(&OverflowError{Root: root})
+	if !d.opts.rescan || d.index.get(root) == nil {
+		return
+	}
+	snapshot, err := scanTree(d, root)
+	if err != nil {
+		return
+	}
+	old := d.index.get(root)
+	d.index.set(root, snapshot)
+	for _, e := range Diff(old, snapshot) {
+		if !d.deliver(e, false) {
+			return
+		}
+	}
+}
+
+// report sends err to the consumer unless the watcher is closed meanwhile.
+func (d *dispatcher) report(err error) {
+	select {
+	case d.errors <- err:
+	case <-d.quitCh:
+	}
+}
+
+// stopped reports that the backend closed its channels, unless that is
+// because the watcher is being closed, and closes the watcher.
+func (d *dispatcher) stopped() {
+	select {
+	case <-d.quitCh:
+	default:
+		err := &BackendError{Err: BackendStoppedErr, Stopped: true}
+		d.fail(err)
+		close(d.stopCh)
+		d.report(err)
+	}
+}
+
+// emitContents reports the entries under dir as created, parents first.
+func (d *dispatcher) emitContents(dir string) {
+	root := d.roots.rootOf(dir)
+	if root == "" {
+		return
+	}
+	filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if err != nil || pth == dir {
+			return nil
+		}
+		if info.IsDir() && d.skipDir(root, pth) {
+			return filepath.SkipDir
+		}
+		d.emit(newEvent(pth, Create, info.IsDir()))
+		return nil
+	})
+}
+
+func (d *dispatcher) allowed(root, pth string, isDir bool) bool {
+	rel := relPath(root, pth)
+	if !d.opts.filter.allows(rel, isDir) {
+		return false
+	}
+	return !d.opts.gitignore || !d.gitignore(root).ignored(rel, isDir)
+}
+
+// skipDir reports whether the directory pth must not be watched.
+func (d *dispatcher) skipDir(root, pth string) bool {
+	rel := relPath(root, pth)
+	if d.opts.filter.excluded(rel) {
+		return true
+	}
+	return d.opts.gitignore && d.gitignore(root).ignored(rel, true)
+}
+
+func (d *dispatcher) gitignore(root string) *gitignore {
+	d.ignoresLock.Lock()
+	defer d.ignoresLock.Unlock()
+	g, ok := d.ignores[root]
+	if !ok {
+		g = newGitignore(root)
+		d.ignores[root] = g
+	}
+	return g
+}
+
+// reloadIgnores drops the rules of the directory of a changed ignore file.
+func (d *dispatcher) reloadIgnores(e Event) {
+	for _, pth := range []string{e.Path, e.OldPath} {
+		if pth == "" || e.IsDir || !isIgnoreFile(pth) {
+			continue
+		}
+		dir := path.Dir(relPath(e.Root, pth))
+		d.gitignore(e.Root).invalidate(dir)
+		if d.onIgnoreChange != nil {
+			d.onIgnoreChange(e.Root, filepath.Join(e.Root, filepath.FromSlash(dir)))
+		}
+	}
+}
+
+// loadState reads the trees saved by an earlier watcher with the same state
+// file. A missing file is not an error.
+func (d *dispatcher) loadState() error {
+	if d.opts.stateFile == "" {
+		return nil
+	}
+	snapshots, err := readState(d.opts.stateFile)
+	if err != nil {
+		return err
+	}
+	d.replayLock.Lock()
+	for _, s := range snapshots {
+		d.saved[s.Root] = s
+	}
+	d.replayLock.Unlock()
+	return nil
+}
+
+// saveState writes the indexed trees of all watched roots to the state file.
+func (d *dispatcher) saveState() error {
+	if d.opts.stateFile == "" {
+		return nil
+	}
+	var snapshots []*Snapshot
+	for _, root := range d.roots.list() {
+		if s := d.index.get(root); s != nil {
+			snapshots = append(snapshots, s)
+		}
+	}
+	d.index.lock.Lock()
+	defer d.index.lock.Unlock()
+	return writeState(d.opts.stateFile, snapshots)
+}
+
+func (d *dispatcher) Events() <-chan Event {
+	return d.events
+}
+
+func (d *dispatcher) Errors() <-chan error {
+	return d.errors
+}
@@ -0,0 +1,207 @@
+package panoptes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var (
+	WatchedRootRemovedErr = fmt.Errorf("Watched root was removed")
+	WatchedRootMovedErr   = fmt.Errorf("Watched root was moved")
+	RootAlreadyWatchedErr = fmt.Errorf("Root is already watched")
+	RootNotWatchedErr     = fmt.Errorf("Root is not watched")
+	EventsOverflowErr     = fmt.Errorf("Events were dropped")
+	WatchLimitErr         = fmt.Errorf("Watch limit reached")
+	BackendStoppedErr     = fmt.Errorf("Backend stopped")
+	WatcherClosedErr      = fmt.Errorf("Watcher was closed")
+)
+
+// Error is implemented by the errors the watchers report on Errors() and
+// return from NewWatcher and Add. Get at it with errors.As:
+//
+//	var perr panoptes.Error
+//	if errors.As(err, &perr) && perr.Fatal() {
+//		// restart the watcher or add the root again
+//	}
+type Error interface {
+	error
+	// Fatal reports whether changes are no longer reported: the root, or
+	// the whole watcher, has to be set up again.
+	Fatal() bool
+}
+
+// IsFatal reports whether err is a fatal Error.
+func IsFatal(err error) bool {
+	var perr Error
+	return errors.As(err, &perr) && perr.Fatal()
+}
+
+// RootRemovedError is reported on Errors() when a watched root is removed.
+// It matches WatchedRootRemovedErr with errors.Is.
+type RootRemovedError struct {
+	Root string
+}
+
+func (e *RootRemovedError) Error() string {
+	return fmt.Sprintf("Watched root was removed: %s", e.Root)
+}
+
+func (e *RootRemovedError) Is(target error) bool {
+	return target == WatchedRootRemovedErr
+}
+
+func (e *RootRemovedError) Fatal() bool {
+	return true
+}
+
+// RootMovedError is reported on Errors() when a watched root is renamed, it
+// is no longer watched. It matches WatchedRootMovedErr with errors.Is.
+type RootMovedError struct {
+	Root string
+}
+
+func (e *RootMovedError) Error() string {
+	return fmt.Sprintf("Watched root was moved: %s", e.Root)
+}
+
+func (e *RootMovedError) Is(target error) bool {
+	return target == WatchedRootMovedErr
+}
+
+func (e *RootMovedError) Fatal() bool {
+	return true
+}
+
+// OverflowError is reported on Errors() when events under Root were lost,
+// the consumer has to rescan it unless WithRescanOnOverflow is used. It
+// matches EventsOverflowErr with errors.Is.
+type OverflowError struct {
+	Root string
+}
+
+func (e *OverflowError) Error() string {
+	return fmt.Sprintf("Events were dropped: %s", e.Root)
+}
+
+func (e *OverflowError) Is(target error) bool {
+	return target == EventsOverflowErr
+}
+
+func (e *OverflowError) Fatal() bool {
+	return false
+}
+
+// WatchLimitError means the system ran out of watches (ENOSPC, see
+// fs.inotify.max_user_watches on linux) or of file descriptors (EMFILE)
+// while watching Path. Subtrees lists the directories whose trees were left
+// without native watches, starting with Path; they are polled with
+// WithPollFallback. It matches WatchLimitErr with errors.Is.
+type WatchLimitError struct {
+	Path     string
+	Subtrees []string
+	Err      error
+}
+
+func (e *WatchLimitError) Error() string {
+	return fmt.Sprintf("Watch limit reached: %s: %s", e.Path, e.Err)
+}
+
+func (e *WatchLimitError) Is(target error) bool {
+	return target == WatchLimitErr
+}
+
+func (e *WatchLimitError) Unwrap() error {
+	return e.Err
+}
+
+func (e *WatchLimitError) Fatal() bool {
+	return false
+}
+
+// PermissionError means Path could not be watched or read. It matches
+// os.ErrPermission with errors.Is.
+type PermissionError struct {
+	Path string
+	Err  error
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("Permission denied: %s: %s", e.Path, e.Err)
+}
+
+func (e *PermissionError) Is(target error) bool {
+	return target == os.ErrPermission
+}
+
+func (e *PermissionError) Unwrap() error {
+	return e.Err
+}
+
+func (e *PermissionError) Fatal() bool {
+	return false
+}
+
+// BackendError wraps an error of the platform API. Stopped is set when the
+// backend stopped delivering events, it then matches BackendStoppedErr with
+// errors.Is.
+type BackendError struct {
+	Err     error
+	Stopped bool
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("Watcher backend failed: %s", e.Err)
+}
+
+func (e *BackendError) Is(target error) bool {
+	return e.Stopped && target == BackendStoppedErr
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+func (e *BackendError) Fatal() bool {
+	return e.Stopped
+}
+
+// QueueError is reported on Errors() of a DiskQueue that cannot write or
+// read its segment files in Dir. The queue stops then.
+type QueueError struct {
+	Dir string
+	Err error
+}
+
+func (e *QueueError) Error() string {
+	return fmt.Sprintf("Event queue failed: %s: %s", e.Dir, e.Err)
+}
+
+func (e *QueueError) Unwrap() error {
+	return e.Err
+}
+
+func (e *QueueError) Fatal() bool {
+	return true
+}
+
+// watchError classifies err of watching pth, other errors are returned as
+// they are.
+func watchError(pth string, err error) error {
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EMFILE):
+		return &WatchLimitError{Path: pth, Err: err}
+	case errors.Is(err, os.ErrPermission):
+		return &PermissionError{Path: pth, Err: err}
+	}
+	return err
+}
+
+// backendError classifies err received from the platform API.
+func backendError(err error) error {
+	if werr := watchError("", err); werr != err {
+		return werr
+	}
+	return &BackendError{Err: err}
+}
@@ -0,0 +1,45 @@
+package panoptes_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Errors", func() {
+
+	It("should match their sentinel errors", func() {
+		Expect(errors.Is(&panoptes.RootRemovedError{Root: "/a"}, panoptes.WatchedRootRemovedErr)).To(BeTrue())
+		Expect(errors.Is(&panoptes.RootMovedError{Root: "/a"}, panoptes.WatchedRootMovedErr)).To(BeTrue())
+		Expect(errors.Is(&panoptes.OverflowError{Root: "/a"}, panoptes.EventsOverflowErr)).To(BeTrue())
+		Expect(errors.Is(&panoptes.WatchLimitError{Path: "/a", Err: syscall.ENOSPC}, panoptes.WatchLimitErr)).To(BeTrue())
+		Expect(errors.Is(&panoptes.PermissionError{Path: "/a", Err: syscall.EACCES}, os.ErrPermission)).To(BeTrue())
+		Expect(errors.Is(&panoptes.BackendError{Err: panoptes.BackendStoppedErr, Stopped: true}, panoptes.BackendStoppedErr)).To(BeTrue())
+	})
+
+	It("should unwrap the system error", func() {
+		err := fmt.Errorf("adding root: %w", &panoptes.WatchLimitError{Path: "/a", Err: syscall.ENOSPC})
+		Expect(errors.Is(err, syscall.ENOSPC)).To(BeTrue())
+
+		var limit *panoptes.WatchLimitError
+		Expect(errors.As(err, &limit)).To(BeTrue())
+		Expect(limit.Path).To(Equal("/a"))
+	})
+
+	It("should tell fatal errors", func() {
+		Expect(panoptes.IsFatal(&panoptes.RootRemovedError{Root: "/a"})).To(BeTrue())
+		Expect(panoptes.IsFatal(&panoptes.RootMovedError{Root: "/a"})).To(BeTrue())
+		Expect(panoptes.IsFatal(&panoptes.BackendError{Err: panoptes.BackendStoppedErr, Stopped: true})).To(BeTrue())
+
+		Expect(panoptes.IsFatal(&panoptes.OverflowError{Root: "/a"})).To(BeFalse())
+		Expect(panoptes.IsFatal(&panoptes.WatchLimitError{Path: "/a", Err: syscall.ENOSPC})).To(BeFalse())
+		Expect(panoptes.IsFatal(&panoptes.PermissionError{Path: "/a", Err: syscall.EACCES})).To(BeFalse())
+		Expect(panoptes.IsFatal(&panoptes.BackendError{Err: errors.New("read failed")})).To(BeFalse())
+		Expect(panoptes.IsFatal(errors.New("other"))).To(BeFalse())
+	})
+})
@@ -36,10 +36,12 @@ func main() {
 }
 
 var eventNames = map[panoptes.Op]string{
-	panoptes.Modify: "MODIFY",
-	panoptes.Create: "CREATE",
-	panoptes.Rename: "RENAME",
-	panoptes.Remove: "REMOVE",
+	panoptes.Modify:   "MODIFY",
+	panoptes.Create:   "CREATE",
+	panoptes.Rename:   "RENAME",
+	panoptes.Remove:   "REMOVE",
+	panoptes.Attrib:   "ATTRIB",
+	panoptes.Overflow: "OVERFLOW",
 }
 
 func logEvent(e panoptes.Event) {
@@ -0,0 +1,24 @@
+// +build !windows
+
+package panoptes
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode numbers of info.
+func fileID(info os.FileInfo) (dev, ino uint64) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), uint64(st.Ino)
+	}
+	return 0, 0
+}
+
+// fileOwner returns the user and group ids of info.
+func fileOwner(info os.FileInfo) (uid, gid uint32) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid
+	}
+	return 0, 0
+}
@@ -0,0 +1,17 @@
+// +build windows
+
+package panoptes
+
+import (
+	"os"
+)
+
+// fileID returns zeros on windows, FileInfo carries no file index there.
+func fileID(info os.FileInfo) (dev, ino uint64) {
+	return 0, 0
+}
+
+// fileOwner returns zeros on windows, files have no uid and gid there.
+func fileOwner(info os.FileInfo) (uid, gid uint32) {
+	return 0, 0
+}
@@ -0,0 +1,116 @@
+package panoptes
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// filter decides which paths are watched and reported. Patterns are globs
+// matched against the slash separated path relative to the watched root.
+// Patterns without a slash match the name of any path element, patterns with
+// a slash match from the root and "**" matches any number of elements.
+type filter struct {
+	include []string
+	exclude []string
+}
+
+func validatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(strings.Replace(p, "**", "*", -1), ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *filter) empty() bool {
+	return len(f.include) == 0 && len(f.exclude) == 0
+}
+
+// excluded reports whether rel or any of its parents matches an exclude
+// pattern. Excluded directories are not watched at all.
+func (f *filter) excluded(rel string) bool {
+	if len(f.exclude) == 0 || rel == "." {
+		return false
+	}
+	for pth := rel; pth != "."; pth = path.Dir(pth) {
+		for _, p := range f.exclude {
+			if matchPattern(p, pth) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// included reports whether rel matches an include pattern. Everything is
+// included when there are no include patterns.
+func (f *filter) included(rel string) bool {
+	if len(f.include) == 0 || rel == "." {
+		return true
+	}
+	for _, p := range f.include {
+		if matchPattern(p, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the event of rel is reported. Include patterns
+// only select files: directories are reported unless excluded, so that the
+// paths of the files in them stay known.
+func (f *filter) allows(rel string, isDir bool) bool {
+	return !f.excluded(rel) && (isDir || f.included(rel))
+}
+
+// relPath returns pth relative to root with forward slashes.
+func relPath(root, pth string) string {
+	rel, err := filepath.Rel(root, pth)
+	if err != nil {
+		return filepath.ToSlash(pth)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func matchPattern(pattern, rel string) bool {
+	if strings.HasPrefix(pattern, "/") {
+		return matchGlob(strings.Split(pattern[1:], "/"), strings.Split(rel, "/"))
+	}
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	return matchGlob(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+// matchGlob matches path elements against pattern elements where "**"
+// matches zero or more elements.
+func matchGlob(pattern, elems []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := range elems {
+				if matchGlob(pattern, elems[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(elems) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		elems = elems[1:]
+	}
+	return len(elems) == 0
+}
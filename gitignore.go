@@ -0,0 +1,165 @@
+package panoptes
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var ignoreFileNames = []string{".gitignore", ".ignore"}
+
+func isIgnoreFile(pth string) bool {
+	name := filepath.Base(pth)
+	for _, n := range ignoreFileNames {
+		if name == n {
+			return true
+		}
+	}
+	return false
+}
+
+type ignorePattern struct {
+	elems    []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// parseIgnorePattern parses one line of an ignore file following the
+// gitignore rules. ok is false for blank lines and comments.
+func parseIgnorePattern(line string) (p ignorePattern, ok bool) {
+	line = strings.TrimRight(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return p, false
+	}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return p, false
+	}
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	line = strings.Replace(line, "\\ ", " ", -1)
+	p.elems = strings.Split(line, "/")
+	return p, true
+}
+
+// match reports whether rel, relative to the directory of the ignore file,
+// matches the pattern.
+func (p *ignorePattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if !p.anchored {
+		ok, _ := path.Match(p.elems[0], path.Base(rel))
+		return ok
+	}
+	return matchGlob(p.elems, strings.Split(rel, "/"))
+}
+
+func readIgnoreFile(name string) (patterns []ignorePattern) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if p, ok := parseIgnorePattern(scanner.Text()); ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// gitignore holds the .gitignore and .ignore rules of one watched root.
+// Rules of a directory are loaded the first time a path below it is checked
+// and dropped when one of its ignore files changes.
+type gitignore struct {
+	lock sync.Mutex
+	root string
+	dirs map[string][]ignorePattern
+}
+
+func newGitignore(root string) *gitignore {
+	return &gitignore{
+		root: root,
+		dirs: make(map[string][]ignorePattern),
+	}
+}
+
+func (g *gitignore) rules(dir string) []ignorePattern {
+	patterns, ok := g.dirs[dir]
+	if !ok {
+		for _, name := range ignoreFileNames {
+			patterns = append(patterns, readIgnoreFile(filepath.Join(g.root, filepath.FromSlash(dir), name))...)
+		}
+		g.dirs[dir] = patterns
+	}
+	return patterns
+}
+
+// invalidate drops the cached rules of dir, which is relative to the root.
+func (g *gitignore) invalidate(dir string) {
+	g.lock.Lock()
+	delete(g.dirs, dir)
+	g.lock.Unlock()
+}
+
+// ignored reports whether rel is ignored. A path inside an ignored directory
+// is ignored too, as git does not look into excluded directories.
+func (g *gitignore) ignored(rel string, isDir bool) bool {
+	if rel == "." {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	elems := strings.Split(rel, "/")
+	for i := 1; i < len(elems); i++ {
+		if g.matches(strings.Join(elems[:i], "/"), true) {
+			return true
+		}
+	}
+	return g.matches(rel, isDir)
+}
+
+// matches applies the rules of all parent directories of rel, deeper files
+// and later lines taking precedence.
+func (g *gitignore) matches(rel string, isDir bool) bool {
+	if path.Base(rel) == ".git" {
+		return true
+	}
+	ignored := false
+	elems := strings.Split(rel, "/")
+	for i := 0; i < len(elems); i++ {
+		dir := "."
+		if i > 0 {
+			dir = strings.Join(elems[:i], "/")
+		}
+		sub := strings.Join(elems[i:], "/")
+		for _, p := range g.rules(dir) {
+			if p.match(sub, isDir) {
+				ignored = !p.negate
+			}
+		}
+	}
+	return ignored
+}
@@ -0,0 +1,102 @@
+package panoptes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"sync"
+)
+
+// contentHashes remembers the content of files to tell rewrites with the
+// same bytes from real modifications (WithContentHash).
+type contentHashes struct {
+	lock    sync.Mutex
+	maxSize int64
+	files   map[string]contentHash
+	paths   *pathTree // of files
+}
+
+type contentHash struct {
+	size int64
+	sum  []byte
+}
+
+func newContentHashes(maxSize int64) *contentHashes {
+	return &contentHashes{
+		maxSize: maxSize,
+		files:   make(map[string]contentHash),
+		paths:   newPathTree(),
+	}
+}
+
+// update records the change e and reports false for a Modify that did not
+// change the content of the file.
+func (h *contentHashes) update(e Event) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	switch e.Op {
+	case Remove:
+		h.removeSubtree(e.Path)
+	case Rename:
+		moved := make(map[string]contentHash)
+		for _, pth := range h.paths.remove(e.OldPath) {
+			if c, ok := h.files[pth]; ok {
+				delete(h.files, pth)
+				moved[e.Path+pth[len(e.OldPath):]] = c
+			}
+		}
+		h.removeSubtree(e.Path)
+		for pth, c := range moved {
+			h.files[pth] = c
+			h.paths.add(pth)
+		}
+	case Create:
+		if !e.IsDir {
+			h.hash(e.Path)
+		}
+	case Modify:
+		// a new size is a change, the same size and mtime are not proof of
+		// none: cp -p, rsync -t and coarse mtimes keep them
+		old, ok := h.files[e.Path]
+		cur, hashed := h.hash(e.Path)
+		return !ok || !hashed || cur.size != old.size || !bytes.Equal(cur.sum, old.sum)
+	}
+	return true
+}
+
+// hash records the content of the regular file pth. Files that are gone,
+// not regular or too large are forgotten.
+func (h *contentHashes) hash(pth string) (c contentHash, ok bool) {
+	delete(h.files, pth)
+
+	info, err := os.Lstat(pth)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > h.maxSize {
+		return c, false
+	}
+	f, err := os.Open(pth)
+	if err != nil {
+		return c, false
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return c, false
+	}
+
+	c = contentHash{
+		size: info.Size(),
+		sum:  sum.Sum(nil),
+	}
+	h.files[pth] = c
+	h.paths.add(pth)
+	return c, true
+}
+
+func (h *contentHashes) removeSubtree(root string) {
+	for _, pth := range h.paths.remove(root) {
+		delete(h.files, pth)
+	}
+}
@@ -0,0 +1,218 @@
+package panoptes
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// treeIndex mirrors the watched trees as the consumer knows them: it is
+// filled by a scan when a root is added and updated with every emitted
+// event. A rescan diffs the index against the real tree, which yields the
+// events the consumer missed.
+type treeIndex struct {
+	lock  sync.Mutex
+	trees map[string]*Snapshot
+	// paths changed by live events since the last scan of the root
+	touched map[string]map[string]bool
+	// the paths of trees and touched by directory, a Remove or Rename
+	// then visits only the moved subtree
+	paths map[string]*pathTree
+}
+
+func newTreeIndex() *treeIndex {
+	return &treeIndex{
+		trees:   make(map[string]*Snapshot),
+		touched: make(map[string]map[string]bool),
+		paths:   make(map[string]*pathTree),
+	}
+}
+
+func (x *treeIndex) set(root string, snapshot *Snapshot) {
+	x.lock.Lock()
+	x.trees[root] = snapshot
+	x.touched[root] = make(map[string]bool)
+	paths := newPathTree()
+	for pth := range snapshot.Entries {
+		paths.add(pth)
+	}
+	x.paths[root] = paths
+	x.lock.Unlock()
+}
+
+func (x *treeIndex) remove(root string) {
+	x.lock.Lock()
+	delete(x.trees, root)
+	delete(x.touched, root)
+	delete(x.paths, root)
+	x.lock.Unlock()
+}
+
+// known reports whether the index already reflects the live event e. This
+// is the case for changes made while the root was being scanned: the scan
+// saw them and the kernel reported them as well. Only entries that no live
+// event changed since the scan are trusted.
+func (x *treeIndex) known(e Event) bool {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	snapshot, ok := x.trees[e.Root]
+	if !ok {
+		return false
+	}
+	touched := x.touched[e.Root]
+
+	scanned := func(pth string) (SnapshotEntry, bool) {
+		entry, ok := snapshot.Entries[pth]
+		return entry, ok && !touched[pth]
+	}
+	current := func(pth string, entry SnapshotEntry) bool {
+		info, err := os.Lstat(pth)
+		if err != nil {
+			return false
+		}
+		cur := newSnapshotEntry(pth, info)
+		return cur.Dev == entry.Dev && cur.Ino == entry.Ino && cur.IsDir == entry.IsDir &&
+			!cur.changed(entry) && !cur.attribChanged(entry)
+	}
+
+	switch e.Op {
+	case Create, Modify, Attrib:
+		entry, ok := scanned(e.Path)
+		return ok && current(e.Path, entry)
+	case Remove:
+		if _, ok := snapshot.Entries[e.Path]; ok || touched[e.Path] {
+			return false
+		}
+		parent := filepath.Dir(e.Path)
+		if parent == e.Root {
+			return true
+		}
+		_, ok := scanned(parent)
+		return ok
+	case Rename:
+		if _, ok := snapshot.Entries[e.OldPath]; ok || touched[e.OldPath] {
+			return false
+		}
+		entry, ok := scanned(e.Path)
+		return ok && current(e.Path, entry)
+	}
+	return false
+}
+
+func (x *treeIndex) entry(root, pth string) (SnapshotEntry, bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	if snapshot, ok := x.trees[root]; ok {
+		entry, ok := snapshot.Entries[pth]
+		return entry, ok
+	}
+	return SnapshotEntry{}, false
+}
+
+func (x *treeIndex) get(root string) *Snapshot {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.trees[root]
+}
+
+func (x *treeIndex) update(e Event) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	snapshot, ok := x.trees[e.Root]
+	if !ok {
+		return
+	}
+	entries := snapshot.Entries
+	touched := x.touched[e.Root]
+	paths := x.paths[e.Root]
+
+	switch e.Op {
+	case Remove:
+		// the consumer knows the paths are gone, they are not kept touched
+		for _, pth := range paths.remove(e.Path) {
+			delete(entries, pth)
+			delete(touched, pth)
+		}
+		return
+	case Rename:
+		for _, pth := range paths.remove(e.OldPath) {
+			moved := e.Path + pth[len(e.OldPath):]
+			if entry, ok := entries[pth]; ok {
+				delete(entries, pth)
+				entries[moved] = entry
+			}
+			if touched[pth] {
+				delete(touched, pth)
+				touched[moved] = true
+			}
+			paths.add(moved)
+		}
+	}
+	touched[e.Path] = true
+	paths.add(e.Path)
+	if info, err := os.Lstat(e.Path); err == nil {
+		entries[e.Path] = newSnapshotEntry(e.Path, info)
+	} else {
+		delete(entries, e.Path)
+		for _, pth := range paths.under(e.Path) {
+			delete(entries, pth)
+		}
+	}
+}
+
+// pathTree links paths to their directories, so that a subtree is found
+// without looking at the other paths.
+type pathTree struct {
+	children map[string]map[string]bool
+}
+
+func newPathTree() *pathTree {
+	return &pathTree{children: make(map[string]map[string]bool)}
+}
+
+// add links pth, and the directories above it, to their parents.
+func (t *pathTree) add(pth string) {
+	for {
+		dir := filepath.Dir(pth)
+		if dir == pth {
+			return
+		}
+		children, ok := t.children[dir]
+		if !ok {
+			children = make(map[string]bool)
+			t.children[dir] = children
+		}
+		children[pth] = true
+		if ok {
+			return
+		}
+		pth = dir
+	}
+}
+
+// remove unlinks the tree of pth and returns its paths, pth included.
+func (t *pathTree) remove(pth string) []string {
+	removed := t.under(pth)
+	for _, child := range removed {
+		delete(t.children, child)
+	}
+	delete(t.children, pth)
+	delete(t.children[filepath.Dir(pth)], pth)
+	return append(removed, pth)
+}
+
+// under returns the paths below pth.
+func (t *pathTree) under(pth string) (paths []string) {
+	dirs := []string{pth}
+	for len(dirs) > 0 {
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+		for child := range t.children[dir] {
+			paths = append(paths, child)
+			dirs = append(dirs, child)
+		}
+	}
+	return paths
+}
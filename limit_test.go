@@ -0,0 +1,83 @@
+package panoptes_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watcher over the watch limit", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		if runtime.GOOS != "linux" {
+			Skip("inotify only")
+		}
+		dir, _ = sc.NewTest()
+		for _, name := range []string{"a", "a/sub", "b", "b/sub", "c"} {
+			mkdir(filepath.Join(dir, name))
+		}
+	})
+
+	It("should report the trees it cannot watch", func() {
+		w, c := newNativeWatcher(dir, panoptes.WithMaxWatches(2))
+		defer closeWatcher(c)
+
+		unwatched := []string{filepath.Join(dir, "a", "sub"), filepath.Join(dir, "b"), filepath.Join(dir, "c")}
+		var err error
+		Eventually(c.Errors()).Should(Receive(&err))
+		Expect(errors.Is(err, panoptes.WatchLimitErr)).To(BeTrue())
+		Expect(errors.Is(err, syscall.ENOSPC)).To(BeTrue())
+		Expect(panoptes.IsFatal(err)).To(BeFalse())
+		Expect(err.(*panoptes.WatchLimitError).Subtrees).To(Equal(unwatched))
+		Expect(w.Unwatched()).To(Equal(unwatched))
+		Expect(w.Stats().Unwatched).To(Equal(3))
+
+		// the watched part still works
+		e := createFile(filepath.Join(dir, "a", "file.txt"), "hello world")
+		Eventually(c.Events()).Should(Receive(Equal(e)))
+		createFile(filepath.Join(dir, "b", "file.txt"), "hello world")
+	})
+
+	It("should poll the trees it cannot watch with poll fallback", func() {
+		_, c := newNativeWatcher(dir,
+			panoptes.WithMaxWatches(2),
+			panoptes.WithPollFallback(),
+			panoptes.WithPollInterval(50*time.Millisecond))
+		defer closeWatcher(c)
+		Eventually(c.Errors()).Should(Receive())
+		// the first pass only sets the state the next ones are compared to
+		time.Sleep(200 * time.Millisecond)
+
+		e := createFile(filepath.Join(dir, "b", "sub", "file.txt"), "hello world")
+		Eventually(c.Events()).Should(Receive(Equal(e)))
+		e = rename(filepath.Join(dir, "b", "sub", "file.txt"), filepath.Join(dir, "b", "file.txt"))
+		Eventually(c.Events()).Should(Receive(Equal(e)))
+		e = mkdir(filepath.Join(dir, "c", "new"))
+		Eventually(c.Events()).Should(Receive(Equal(e)))
+		e = remove(filepath.Join(dir, "b", "file.txt"))
+		Eventually(c.Events()).Should(Receive(Equal(e)))
+
+		// native events keep coming from the watched part
+		e = createFile(filepath.Join(dir, "file.txt"), "hello world")
+		Eventually(c.Events()).Should(Receive(Equal(e)))
+	})
+
+	It("should stop polling trees that are removed", func() {
+		w, c := newNativeWatcher(dir, panoptes.WithMaxWatches(2), panoptes.WithPollFallback())
+		defer closeWatcher(c)
+		Eventually(c.Errors()).Should(Receive())
+
+		Expect(os.RemoveAll(filepath.Join(dir, "c"))).To(Succeed())
+		Eventually(c.Events()).Should(Receive(Equal(panoptes.Event{Path: filepath.Join(dir, "c"), Op: panoptes.Remove, IsDir: true, Root: dir})))
+		Eventually(w.Unwatched).Should(Equal([]string{filepath.Join(dir, "a", "sub"), filepath.Join(dir, "b")}))
+	})
+})
@@ -0,0 +1,51 @@
+package panoptes
+
+import (
+	"os"
+	"time"
+)
+
+// Metadata is the state of a file when its event was processed
+// (WithMetadata).
+type Metadata struct {
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	Dev     uint64 // zero on windows
+	Ino     uint64 // zero on windows
+	Uid     uint32 // zero on windows
+	Gid     uint32 // zero on windows
+	// LinkTarget is the contents of a symlink, Mode has os.ModeSymlink set.
+	LinkTarget string
+}
+
+func newMetadata(pth string) *Metadata {
+	info, err := os.Lstat(pth)
+	if err != nil {
+		return nil
+	}
+	m := &Metadata{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	}
+	m.Dev, m.Ino = fileID(info)
+	m.Uid, m.Gid = fileOwner(info)
+	if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+		m.LinkTarget, _ = os.Readlink(pth)
+	}
+	return m
+}
+
+// entryMetadata returns the metadata recorded in a snapshot entry.
+func entryMetadata(e SnapshotEntry) *Metadata {
+	return &Metadata{
+		Size:    e.Size,
+		ModTime: e.ModTime,
+		Mode:    e.Mode,
+		Dev:     e.Dev,
+		Ino:     e.Ino,
+		Uid:     e.Uid,
+		Gid:     e.Gid,
+	}
+}
@@ -0,0 +1,253 @@
+package panoptes
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultEventBufferSize = 1024
+	DefaultRenameTimeout   = 500 * time.Millisecond
+	DefaultCreateTimeout   = 3 * time.Second
+	DefaultLatency         = 1 * time.Millisecond
+	DefaultPollInterval    = 1 * time.Second
+	DefaultHashMaxSize     = 16 << 20
+)
+
+// Backpressure is what a watcher does with an event when the consumer fell
+// behind and Events() is full.
+type Backpressure int
+
+const (
+	// BackpressureBlock waits for room in Events(). Meanwhile no raw events
+	// are read and the kernel may drop them, see OverflowError.
+	BackpressureBlock Backpressure = iota
+	// BackpressureDrop drops the event and queues an Overflow event for its
+	// root, so the consumer knows to rescan it. Events keep being dropped
+	// until the Overflow events were delivered.
+	BackpressureDrop
+	// BackpressureSpill queues the event in memory, without a limit. A
+	// DiskQueue queues events on disk instead.
+	BackpressureSpill
+)
+
+// Option configures a Watcher. Every backend accepts every option and
+// ignores the ones that do not apply to it.
+type Option func(*options)
+
+type options struct {
+	eventBufferSize int
+	renameTimeout   time.Duration
+	createTimeout   time.Duration
+	latency         time.Duration
+	pollInterval    time.Duration
+	pollBudget      int
+	filter          filter
+	gitignore       bool
+	rescan          bool
+	stateFile       string
+	metadata        bool
+	movedContents   bool
+	contentHash     bool
+	hashMaxSize     int64
+	pollFallback    bool
+	maxWatches      int
+	backpressure    Backpressure
+	err             error
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		eventBufferSize: DefaultEventBufferSize,
+		renameTimeout:   DefaultRenameTimeout,
+		createTimeout:   DefaultCreateTimeout,
+		latency:         DefaultLatency,
+		pollInterval:    DefaultPollInterval,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithEventBufferSize sets the capacity of the Events() channel.
+func WithEventBufferSize(n int) Option {
+	return func(o *options) {
+		if n >= 0 {
+			o.eventBufferSize = n
+		}
+	}
+}
+
+// WithRenameTimeout sets how long a move out of a watched directory waits for
+// its matching move in before it is reported as Remove.
+func WithRenameTimeout(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.renameTimeout = d
+		}
+	}
+}
+
+// WithCreateTimeout sets how long a new file waits for its first write to
+// end before Create is reported anyway (linux, windows).
+func WithCreateTimeout(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.createTimeout = d
+		}
+	}
+}
+
+// WithLatency sets the fsevents stream latency (darwin).
+func WithLatency(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.latency = d
+		}
+	}
+}
+
+// WithPollInterval sets how often PollWatcher scans (poll).
+func WithPollInterval(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.pollInterval = d
+		}
+	}
+}
+
+// WithPollBudget limits how many files PollWatcher stats per interval, a
+// scan of a larger tree is spread over several intervals. Zero means no
+// limit (poll).
+func WithPollBudget(n int) Option {
+	return func(o *options) {
+		if n >= 0 {
+			o.pollBudget = n
+		}
+	}
+}
+
+// WithInclude only reports files matching at least one of patterns.
+// Directories are watched and reported as without it. See WithExclude for
+// the pattern syntax.
+func WithInclude(patterns ...string) Option {
+	return func(o *options) {
+		if err := validatePatterns(patterns); err != nil {
+			o.err = err
+		}
+		o.filter.include = append(o.filter.include, patterns...)
+	}
+}
+
+// WithExclude skips paths matching any of patterns. Patterns are globs
+// matched against the slash separated path relative to the watched root;
+// patterns without a slash match any path element (e.g. "node_modules"),
+// "**" matches any number of elements (e.g. "build/**/*.o"). Excluded
+// directories are not watched.
+func WithExclude(patterns ...string) Option {
+	return func(o *options) {
+		if err := validatePatterns(patterns); err != nil {
+			o.err = err
+		}
+		o.filter.exclude = append(o.filter.exclude, patterns...)
+	}
+}
+
+// WithGitignore skips paths ignored by .gitignore and .ignore files in the
+// watched tree, following git's rules. Ignored directories are not watched
+// and the rules are reloaded when an ignore file changes.
+func WithGitignore() Option {
+	return func(o *options) {
+		o.gitignore = true
+	}
+}
+
+// WithRescanOnOverflow keeps an index of the watched trees. When the kernel
+// drops events, the watcher reports an OverflowError and then rescans the
+// root, reporting the changes that were lost.
+func WithRescanOnOverflow() Option {
+	return func(o *options) {
+		o.rescan = true
+	}
+}
+
+// WithStateFile keeps an index of the watched trees and saves it to path on
+// Close. A later watcher with the same state file first reports the changes
+// made in between, marked Offline, and then the live events. Events still
+// buffered in Events() at Close count as delivered.
+func WithStateFile(path string) Option {
+	return func(o *options) {
+		o.stateFile = path
+	}
+}
+
+// WithMetadata fills Event.Meta, which costs a stat per event, and
+// Event.OldMeta of Attrib events, for which an index of the watched trees
+// is kept.
+func WithMetadata() Option {
+	return func(o *options) {
+		o.metadata = true
+	}
+}
+
+// WithContentHash suppresses Modify events of files whose content did not
+// change, e.g. when a build tool rewrites a file with the same bytes. Every
+// created or modified file is hashed, also when its size and mtime did not
+// change. Hashing runs apart from the backend, but the events after a file
+// wait for its hash. Files larger than
+// maxSize, DefaultHashMaxSize if it is not positive, are not hashed and
+// always reported. The first Modify of a file that existed before the
+// watcher started is always reported.
+func WithContentHash(maxSize int64) Option {
+	return func(o *options) {
+		if maxSize <= 0 {
+			maxSize = DefaultHashMaxSize
+		}
+		o.contentHash = true
+		o.hashMaxSize = maxSize
+	}
+}
+
+// WithMovedContents reports the entries of a directory moved into a watched
+// root from outside as created, after the Create of the directory itself
+// (linux, windows).
+func WithMovedContents() Option {
+	return func(o *options) {
+		o.movedContents = true
+	}
+}
+
+// WithPollFallback polls the directories that cannot be watched natively
+// because the watch limit was reached (fs.inotify.max_user_watches or
+// WithMaxWatches), every poll interval and within the poll budget. Their
+// changes are reported on Events() like the others, renames within them
+// are detected by inode numbers. Without it they are not watched (linux).
+func WithPollFallback() Option {
+	return func(o *options) {
+		o.pollFallback = true
+	}
+}
+
+// WithMaxWatches caps the inotify watches the watcher uses. Directories
+// over the cap are treated as if the system limit was reached, which
+// leaves watches to other programs. Zero means no cap (linux).
+func WithMaxWatches(n int) Option {
+	return func(o *options) {
+		if n >= 0 {
+			o.maxWatches = n
+		}
+	}
+}
+
+// WithBackpressure sets what happens when Events() is full, the default is
+// BackpressureBlock. Stats counts how often it happened.
+func WithBackpressure(p Backpressure) Option {
+	return func(o *options) {
+		if p < BackpressureBlock || p > BackpressureSpill {
+			o.err = fmt.Errorf("Invalid backpressure policy: %d", p)
+			return
+		}
+		o.backpressure = p
+	}
+}
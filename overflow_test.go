@@ -0,0 +1,85 @@
+package panoptes_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watcher overflow", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		if runtime.GOOS != "linux" {
+			Skip("inotify only")
+		}
+		dir, _ = sc.NewTest()
+	})
+
+	// maxQueuedEvents returns how many events inotify queues before it
+	// overflows.
+	maxQueuedEvents := func() int {
+		data, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_queued_events")
+		Expect(err).NotTo(HaveOccurred())
+		n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		Expect(err).NotTo(HaveOccurred())
+		return n
+	}
+
+	It("should report overflow and rescan", func() {
+		n := maxQueuedEvents()
+		w := newWatcher(dir, panoptes.WithEventBufferSize(16), panoptes.WithRescanOnOverflow())
+		defer w.Close()
+
+		missing := map[string]bool{}
+		for i := 0; i < n; i++ {
+			pth := filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+			createFile(pth, "hello world")
+			missing[pth] = true
+		}
+
+		overflowed := false
+		timeout := time.After(time.Minute)
+		for len(missing) > 0 {
+			select {
+			case e := <-w.Events():
+				if e.Op == panoptes.Create {
+					delete(missing, e.Path)
+				}
+			case err := <-w.Errors():
+				Expect(err).To(Equal(&panoptes.OverflowError{Root: dir}))
+				overflowed = true
+			case <-timeout:
+				Fail(fmt.Sprintf("%d files were not reported", len(missing)))
+			}
+		}
+		Expect(overflowed).To(BeTrue())
+	})
+
+	It("should not rescan without WithRescanOnOverflow", func() {
+		n := maxQueuedEvents()
+		// the index kept for the metadata must not be rescanned
+		w := newWatcher(dir, panoptes.WithEventBufferSize(16), panoptes.WithMetadata())
+		defer w.Close()
+
+		for i := 0; i < n+1; i++ {
+			createFile(filepath.Join(dir, fmt.Sprintf("file%d.txt", i)), "hello world")
+		}
+
+		events, errs := drain(w, 2*time.Second)
+		Expect(errs).NotTo(BeEmpty())
+		for _, err := range errs {
+			Expect(err).To(Equal(&panoptes.OverflowError{Root: dir}))
+		}
+		Expect(len(events)).To(BeNumerically("<", n+1))
+	})
+})
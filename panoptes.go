@@ -1,9 +1,5 @@
 package panoptes
 
-import (
-	"fmt"
-)
-
 type Op uint32
 type RawOp uint32
 
@@ -12,6 +8,10 @@ const (
 	Modify                // 2
 	Remove                // 4
 	Rename                // 8
+	Attrib                // 16, mode, owner, mtime or extended attributes
+	// Overflow marks that events of Root were dropped before it because the
+	// consumer fell behind (BackpressureDrop), Root has to be rescanned.
+	Overflow // 32
 )
 
 func (op Op) String() string {
@@ -24,19 +24,50 @@ func (op Op) String() string {
 		return "remove"
 	case Rename:
 		return "rename"
+	case Attrib:
+		return "attrib"
+	case Overflow:
+		return "overflow"
 	}
 	return "unknown"
 }
 
-var (
-	WatchedRootRemovedErr = fmt.Errorf("Watched root was removed")
-)
+// Stats counts the state a watcher holds, it is meant for monitoring. All
+// of it is bounded and pending entries expire, except the Backlog of
+// BackpressureSpill. Blocked, Dropped and Spilled count since the watcher
+// started.
+type Stats struct {
+	Watches        int // watched directories (linux)
+	PendingCreates int // new files waiting for their first write to end
+	PendingRenames int // moves out waiting for their move in (linux)
+	ScannedPaths   int // paths reported by rescans of new directories (linux)
+	QueuedEvents   int // events held back behind a pending move out (linux)
+	Unwatched      int // trees without watches because of the watch limit (linux)
+	Blocked        int // events that waited for room in Events() (BackpressureBlock)
+	Dropped        int // events dropped because Events() was full (BackpressureDrop)
+	Spilled        int // events queued because Events() was full (BackpressureSpill)
+	Backlog        int // events and Overflow markers queued for Events()
+}
 
 type Event struct {
 	Path    string
 	OldPath string
 	Op      Op
 	IsDir   bool
+	Root    string // watched root the event belongs to
+	// Meta describes the file as it was when the event was processed, it is
+	// nil for Remove, without WithMetadata and if the file is already gone.
+	Meta *Metadata
+	// OldMeta is the state before an Attrib event as far as the watcher
+	// knows it (WithMetadata).
+	OldMeta *Metadata
+	// Offline is set for changes made while no watcher was running, they
+	// are found by comparing the tree with the state file (WithStateFile)
+	// and precede all live events.
+	Offline bool
+	// Seq numbers the events of one watcher in the order they are delivered,
+	// starting at 1 without gaps.
+	Seq uint64
 }
 
 func newEvent(path string, op Op, isDir bool) Event {
@@ -47,8 +78,25 @@ func newRenameEvent(path string, oldPath string, isDir bool) Event {
 	return Event{Path: path, Op: Rename, OldPath: oldPath, IsDir: isDir}
 }
 
+// Watcher reports changes under its roots. Events are delivered in the order
+// the changes were observed: on linux and windows in the order of the raw
+// events, a rename when its new name arrives; on darwin in the order of
+// fsevents; with polling in the order of Diff within each scan. The changes
+// of one path are never reordered. Offline changes precede live ones.
+//
+// A watcher created by NewWatcherContext or NewPollWatcherContext is closed
+// like Close does when its context is cancelled and Err returns the cause,
+// the error of context.WithCancelCause from go 1.20 on and ctx.Err() before;
+// the initial walk of the root stops early then.
 type Watcher interface {
 	Events() <-chan Event
 	Errors() <-chan error
+	// Add starts watching another root.
+	Add(root string) error
+	// Remove stops watching a root previously passed to NewWatcher or Add.
+	Remove(root string) error
+	// Close stops the watcher and returns once its goroutines exited,
+	// Events() and Errors() are closed then. Wrappers close the watcher
+	// they wrap. It is safe to call concurrently and more than once.
 	Close() error
 }
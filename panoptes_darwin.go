@@ -3,44 +3,130 @@
 package panoptes
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/koofr/fsevents"
 )
 
 type DarwinWatcher struct {
-	watchedPath string
-	events      chan Event
-	errors      chan error
-	raw         *fsevents.EventStream
-	isClosed    bool
-	quitCh      chan error
+	dispatcher
+	rawLock  sync.Mutex
+	raw      *fsevents.EventStream
+	isClosed bool
 }
 
-func NewWatcher(path string) (w *DarwinWatcher, err error) {
+func NewWatcher(path string, opts ...Option) (*DarwinWatcher, error) {
+	return NewWatcherContext(context.Background(), path, opts...)
+}
+
+// NewWatcherContext is NewWatcher bound to ctx, see Watcher.
+func NewWatcherContext(ctx context.Context, path string, opts ...Option) (w *DarwinWatcher, err error) {
+	o := newOptions(opts)
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	path = filepath.Clean(path)
 
 	raw := &fsevents.EventStream{
 		Paths:   []string{path},
-		Latency: 1 * time.Millisecond,
+		Latency: o.latency,
 		Flags:   fsevents.FileEvents | fsevents.NoDefer,
+		EventID: fsevents.LatestEventID(),
 	}
 
 	w = &DarwinWatcher{
-		watchedPath: path,
-		events:      make(chan Event, 1024),
-		errors:      make(chan error),
-		quitCh:      make(chan error),
-		raw:         raw,
+		dispatcher: newDispatcher(ctx, o),
+		raw:        raw,
 	}
-	w.raw.Start()
-	go w.translateEvents()
+	if err := w.loadState(); err != nil {
+		return nil, err
+	}
+	w.roots.add(path)
+	if err := w.watchRoot(path, func() (*Snapshot, error) {
+		w.raw.Start()
+		return nil, nil
+	}); err != nil {
+		w.Close()
+		return nil, err
+	}
+	w.spawn(w.translateEvents)
+	w.supervise(w.Close)
 
 	return
 }
 
+// Add restarts the event stream with root added to its paths.
+func (w *DarwinWatcher) Add(root string) error {
+	root = filepath.Clean(root)
+	if _, err := os.Stat(root); err != nil {
+		return err
+	}
+	if err := w.roots.add(root); err != nil {
+		return err
+	}
+	return w.watchRoot(root, func() (*Snapshot, error) {
+		w.restart()
+		return nil, nil
+	})
+}
+
+// Remove restarts the event stream without root.
+func (w *DarwinWatcher) Remove(root string) error {
+	root = filepath.Clean(root)
+	if err := w.roots.remove(root); err != nil {
+		return err
+	}
+	w.restart()
+	w.unindexRoot(root)
+	return nil
+}
+
+func (w *DarwinWatcher) restart() {
+	w.rawLock.Lock()
+	defer w.rawLock.Unlock()
+	if w.isClosed {
+		return
+	}
+	// the stream resumes after the last event it reported, the changes made
+	// while it was stopped are reported then
+	eventID := w.raw.EventID
+	w.raw.Stop()
+	w.raw.Paths = w.roots.list()
+	if len(w.raw.Paths) > 0 {
+		w.raw.EventID = eventID
+		w.raw.Resume = true
+		w.raw.Start()
+	}
+}
+
+// rootOf also resolves paths reported under /private for roots given
+// through the /tmp and /var symlinks.
+func (w *DarwinWatcher) rootOf(pth string) string {
+	if root := w.roots.rootOf(pth); root != "" {
+		return root
+	}
+	return w.roots.rootOf(strings.TrimPrefix(pth, "/private"))
+}
+
+func (w *DarwinWatcher) isRoot(pth string) (string, bool) {
+	for _, root := range w.roots.list() {
+		if root == pth || pth == filepath.Join("private", root) || pth == filepath.Join("/private", root) {
+			return root, true
+		}
+	}
+	return "", false
+}
+
+func (w *DarwinWatcher) emitEvent(e Event) {
+	e.Root = w.rootOf(e.Path)
+	w.emit(e)
+}
+
 var noteDescription = map[fsevents.EventFlags]string{
 	fsevents.MustScanSubDirs: "MustScanSubdirs",
 	fsevents.UserDropped:     "UserDropped",
@@ -64,41 +150,74 @@ var noteDescription = map[fsevents.EventFlags]string{
 	fsevents.ItemIsSymlink:     "IsSymLink",
 }
 
+// Stats reports the state the watcher holds, which is only the backlog of
+// events: fsevents reports complete events.
+func (w *DarwinWatcher) Stats() Stats {
+	return w.stats()
+}
+
+// Unwatched returns nil, fsevents watches whole trees without a limit.
+func (w *DarwinWatcher) Unwatched() []string {
+	return nil
+}
+
 func isDir(e fsevents.Event) bool {
 	return e.Flags&fsevents.ItemIsDir == fsevents.ItemIsDir
 }
 
 func (w *DarwinWatcher) translateEvents() {
-
-	defer func() {
-		close(w.events)
-		close(w.errors)
-	}()
-
 	for {
 		select {
 		case <-w.quitCh:
 			return
 		case events, ok := <-w.raw.Events:
 			if !ok {
+				w.stopped()
 				return
 			}
 
 			for _, event := range events {
-				if w.raw.Paths[0] == event.Path || event.Path == filepath.Join("private", w.raw.Paths[0]) {
+				if event.Flags&fsevents.HistoryDone == fsevents.HistoryDone {
+					// ends the events replayed by a restart
+					continue
+				}
+				if event.Flags&(fsevents.KernelDropped|fsevents.UserDropped) != 0 {
+					for _, root := range w.roots.list() {
+						w.overflow(root)
+					}
+					continue
+				}
+				if event.Flags&fsevents.MustScanSubDirs == fsevents.MustScanSubDirs {
+					if root := w.rootOf(event.Path); root != "" {
+						w.overflow(root)
+					}
+					continue
+				}
+				if root, ok := w.isRoot(event.Path); ok {
+					var err error
 					if event.Flags&fsevents.ItemRemoved == fsevents.ItemRemoved {
-						w.errors <- WatchedRootRemovedErr
+						err = &RootRemovedError{Root: root}
+					} else if event.Flags&fsevents.ItemRenamed == fsevents.ItemRenamed {
+						if _, serr := os.Lstat(root); serr != nil {
+							err = &RootMovedError{Root: root}
+						}
+					}
+					if err != nil && w.roots.remove(root) == nil {
+						// the stream cannot be stopped from its own events
+						w.spawn(w.restart)
+						w.unindexRoot(root)
+						w.report(err)
 					}
 					continue
 				}
 				switch {
 				case event.Flags&fsevents.ItemRenamed == fsevents.ItemRenamed:
-					w.events <- newEvent(event.Path, Rename, isDir(event))
+					w.emitEvent(newEvent(event.Path, Rename, isDir(event)))
 				case event.Flags&fsevents.ItemRemoved == fsevents.ItemRemoved:
-					w.events <- newEvent(event.Path, Remove, isDir(event))
+					w.emitEvent(newEvent(event.Path, Remove, isDir(event)))
 				case event.Flags&fsevents.ItemModified == fsevents.ItemModified &&
 					event.Flags&fsevents.ItemInodeMetaMod == fsevents.ItemInodeMetaMod:
-					w.events <- newEvent(event.Path, Modify, isDir(event))
+					w.emitEvent(newEvent(event.Path, Modify, isDir(event)))
 				case event.Flags&fsevents.ItemCreated == fsevents.ItemCreated:
 					info, err := os.Stat(event.Path)
 					if err != nil {
@@ -134,36 +253,31 @@ func (w *DarwinWatcher) translateEvents() {
 									}
 								}
 
-								if !recursive && strings.HasPrefix(lnk, w.watchedPath) {
-									w.events <- newEvent(event.Path, Create, true)
+								if !recursive && isUnder(lnk, w.rootOf(event.Path)) {
+									w.emitEvent(newEvent(event.Path, Create, true))
 								}
 							}
 						} else {
-							w.events <- newEvent(event.Path, Create, false)
+							w.emitEvent(newEvent(event.Path, Create, false))
 						}
 					} else {
-						w.events <- newEvent(event.Path, Create, isDir(event))
+						w.emitEvent(newEvent(event.Path, Create, isDir(event)))
 					}
+				case event.Flags&(fsevents.ItemInodeMetaMod|fsevents.ItemChangeOwner|fsevents.ItemXattrMod) != 0:
+					w.emitEvent(newEvent(event.Path, Attrib, isDir(event)))
 				}
 			}
 		}
 	}
 }
 
-func (w *DarwinWatcher) Events() <-chan Event {
-	return w.events
-}
-
-func (w *DarwinWatcher) Errors() <-chan error {
-	return w.errors
-}
-
+// Close stops the event stream.
 func (w *DarwinWatcher) Close() error {
-	if w.isClosed {
+	return w.shutdown(func() error {
+		w.rawLock.Lock()
+		w.isClosed = true
+		w.raw.Stop()
+		w.rawLock.Unlock()
 		return nil
-	}
-	w.isClosed = true
-	close(w.quitCh)
-	w.raw.Stop()
-	return nil
+	})
 }
@@ -4,16 +4,110 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/koofr/panoptes"
+	"github.com/onsi/ginkgo"
 	"github.com/onsi/gomega"
 )
 
-func newWatcher(path string) panoptes.Watcher {
-	w, err := panoptes.NewWatcher(path)
+// watchedRoot is the root the helpers put into expected events.
+var watchedRoot string
+
+func newWatcher(path string, opts ...panoptes.Option) panoptes.Watcher {
+	_, c := newNativeWatcher(path, opts...)
+	return c
+}
+
+// nativeWatcher is what the watchers of all platforms have besides Watcher.
+type nativeWatcher interface {
+	panoptes.Watcher
+	Stats() panoptes.Stats
+	Unwatched() []string
+}
+
+// newNativeWatcher is newWatcher for specs that need the watcher itself as
+// well, c delivers its checked events.
+func newNativeWatcher(path string, opts ...panoptes.Option) (w nativeWatcher, c *seqChecker) {
+	nw, err := panoptes.NewWatcher(path, opts...)
+	gomega.Expect(err).NotTo(gomega.HaveOccurred())
+	watchedRoot = filepath.Clean(path)
+	return nw, checkSeq(nw)
+}
+
+func newPollWatcher(path string, opts ...panoptes.Option) panoptes.Watcher {
+	opts = append([]panoptes.Option{panoptes.WithPollInterval(50 * time.Millisecond)}, opts...)
+	w, err := panoptes.NewPollWatcher(path, opts...)
 	gomega.Expect(err).NotTo(gomega.HaveOccurred())
-	return w
+	watchedRoot = filepath.Clean(path)
+	return checkSeq(w)
+}
+
+// seqChecker fails the spec when the events of its watcher are not numbered
+// 1, 2, 3, ... and clears Seq, so specs can compare events with Equal.
+type seqChecker struct {
+	panoptes.Watcher
+	events    chan panoptes.Event
+	quitCh    chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func checkSeq(w panoptes.Watcher) *seqChecker {
+	c := &seqChecker{
+		Watcher: w,
+		events:  make(chan panoptes.Event),
+		quitCh:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *seqChecker) run() {
+	defer ginkgo.GinkgoRecover()
+	defer close(c.done)
+	defer close(c.events)
+
+	var seq uint64
+	for e := range c.Watcher.Events() {
+		seq++
+		gomega.Expect(e.Seq).To(gomega.Equal(seq), "sequence number of %v", e)
+		e.Seq = 0
+		select {
+		case c.events <- e:
+		case <-c.quitCh:
+			return
+		}
+	}
+}
+
+func (c *seqChecker) Events() <-chan panoptes.Event {
+	return c.events
+}
+
+func (c *seqChecker) Close() (err error) {
+	c.closeOnce.Do(func() {
+		close(c.quitCh)
+		err = c.Watcher.Close()
+		<-c.done
+	})
+	return
+}
+
+// drain receives the events and errors of w until none arrived for quiet.
+func drain(w panoptes.Watcher, quiet time.Duration) (events []panoptes.Event, errs []error) {
+	for {
+		select {
+		case e := <-w.Events():
+			events = append(events, e)
+		case err := <-w.Errors():
+			errs = append(errs, err)
+		case <-time.After(quiet):
+			return
+		}
+	}
 }
 
 func closeWatcher(w panoptes.Watcher) {
@@ -34,6 +128,7 @@ func mkdir(path string) panoptes.Event {
 		Path:  path,
 		Op:    panoptes.Create,
 		IsDir: true,
+		Root:  watchedRoot,
 	}
 }
 
@@ -50,6 +145,7 @@ func symlink(a, b string) panoptes.Event {
 		Path:  b,
 		Op:    panoptes.Create,
 		IsDir: info.IsDir(),
+		Root:  watchedRoot,
 	}
 }
 
@@ -62,6 +158,7 @@ func remove(path string) panoptes.Event {
 		Path:  path,
 		Op:    panoptes.Remove,
 		IsDir: info.IsDir(),
+		Root:  watchedRoot,
 	}
 }
 
@@ -72,6 +169,7 @@ func createFile(path string, contents string) panoptes.Event {
 	return panoptes.Event{
 		Path: path,
 		Op:   panoptes.Create,
+		Root: watchedRoot,
 	}
 }
 
@@ -90,6 +188,7 @@ func modifyFile(path string, contents string) panoptes.Event {
 	return panoptes.Event{
 		Path: path,
 		Op:   panoptes.Modify,
+		Root: watchedRoot,
 	}
 }
 
@@ -103,5 +202,6 @@ func rename(oldpth, newpth string) panoptes.Event {
 		OldPath: oldpth,
 		Op:      panoptes.Rename,
 		IsDir:   info.IsDir(),
+		Root:    watchedRoot,
 	}
 }
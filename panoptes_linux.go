@@ -3,10 +3,11 @@
 package panoptes
 
 import (
+	"context"
+	"errors"
 	"os"
 	"path"
 	"path/filepath"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -14,210 +15,569 @@ import (
 	"github.com/koofr/fsnotify"
 )
 
+// scannedExpiry is how long a path reported by a rescan of a new directory
+// waits for the kernel to report it as well.
+const scannedExpiry = 10 * time.Second
+
+type scannedEntry struct {
+	entry SnapshotEntry
+	at    time.Time
+}
+
 type LinuxWatcher struct {
-	watchedPath string
-	events      chan Event
-	errors      chan error
-	movedToLock sync.RWMutex
-	movedTo     map[uint32]chan string
-	createdLock sync.RWMutex
-	created     map[string]chan error
-	raw         *fsnotify.Watcher
-	quitCh      chan error
-	isClosed    bool
-}
-
-func NewWatcher(path string) (w *LinuxWatcher, err error) {
+	dispatcher
+	watchesLock sync.Mutex
+	watches     map[string]bool
+	// pairing state, see pending_linux.go
+	pendingLock sync.Mutex
+	queue       []*queuedEvent
+	moves       map[uint32]*queuedEvent
+	created     *createQueue
+	scannedLock sync.Mutex
+	scanned     map[string]scannedEntry
+	// trees left without watches by the watch limit, with their scans when
+	// WithPollFallback is used; see unwatched_linux.go
+	unwatchedLock sync.Mutex
+	unwatched     map[string]*pollScan
+	pollNext      int
+	raw           *fsnotify.Watcher
+}
+
+func NewWatcher(path string, opts ...Option) (*LinuxWatcher, error) {
+	return NewWatcherContext(context.Background(), path, opts...)
+}
+
+// NewWatcherContext is NewWatcher bound to ctx, see Watcher.
+func NewWatcherContext(ctx context.Context, path string, opts ...Option) (w *LinuxWatcher, err error) {
+	o := newOptions(opts)
+	if o.err != nil {
+		return nil, o.err
+	}
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return
 	}
 
 	w = &LinuxWatcher{
-		watchedPath: path,
-		events:      make(chan Event, 1024),
-		errors:      make(chan error),
-		movedTo:     make(map[uint32]chan string),
-		created:     make(map[string]chan error),
-		quitCh:      make(chan error),
-		raw:         watcher,
+		dispatcher: newDispatcher(ctx, o),
+		watches:    make(map[string]bool),
+		moves:      make(map[uint32]*queuedEvent),
+		created:    newCreateQueue(),
+		scanned:    make(map[string]scannedEntry),
+		unwatched:  make(map[string]*pollScan),
+		raw:        watcher,
+	}
+	w.onIgnoreChange = w.resyncWatches
+
+	if err := w.loadState(); err != nil {
+		watcher.Close()
+		return nil, err
 	}
 
-	go w.translateEvents()
+	w.spawn(w.translateEvents)
 
-	if err := w.recursiveAdd(path); err != nil {
+	if err := w.Add(path); err != nil {
+		w.Close()
 		return nil, err
 	}
+	w.supervise(w.Close)
 	return
 }
 
+func (w *LinuxWatcher) Add(root string) error {
+	root = filepath.Clean(root)
+	if err := w.roots.add(root); err != nil {
+		return err
+	}
+	install := func() (*Snapshot, error) {
+		err := w.recursiveAdd(root)
+		// without polling, a root over the limit is not watched at all
+		var limit *WatchLimitError
+		if errors.As(err, &limit) && (limit.Path != root || w.opts.pollFallback) {
+			w.spawn(func() { w.report(err) })
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := w.watchRoot(root, install); err != nil {
+		w.roots.remove(root)
+		w.removeWatches(root)
+		return err
+	}
+	return nil
+}
+
+func (w *LinuxWatcher) Remove(root string) error {
+	root = filepath.Clean(root)
+	if err := w.roots.remove(root); err != nil {
+		return err
+	}
+	w.removeWatches(root)
+	w.unindexRoot(root)
+	return nil
+}
+
+// removeWatches drops the watches under root that no other root still covers.
+func (w *LinuxWatcher) removeWatches(root string) {
+	w.watchesLock.Lock()
+	defer w.watchesLock.Unlock()
+	for pth := range w.watches {
+		if isUnder(pth, root) && w.roots.rootOf(pth) == "" {
+			w.raw.Remove(pth)
+			delete(w.watches, pth)
+		}
+	}
+
+	w.unwatchedLock.Lock()
+	defer w.unwatchedLock.Unlock()
+	for pth := range w.unwatched {
+		if isUnder(pth, root) && w.roots.rootOf(pth) == "" {
+			delete(w.unwatched, pth)
+		}
+	}
+}
+
+// resyncWatches adds and removes watches under dir after the ignore rules
+// of dir changed.
+func (w *LinuxWatcher) resyncWatches(root, dir string) {
+	w.watchesLock.Lock()
+	for pth := range w.watches {
+		if pth != dir && isUnder(pth, dir) && w.skipDir(root, pth) {
+			w.raw.Remove(pth)
+			delete(w.watches, pth)
+		}
+	}
+	w.watchesLock.Unlock()
+	if err := w.recursiveAdd(dir); err != nil {
+		w.report(err)
+	}
+}
+
+// moveWatches follows a directory renamed within the watched roots. The
+// watches under it are registered again at their new paths, the kernel
+// keeps their descriptors and reports the new paths from then on.
+func (w *LinuxWatcher) moveWatches(oldPth, newPth string) {
+	root := w.roots.rootOf(newPth)
+
+	w.watchesLock.Lock()
+	var moved []string
+	for pth := range w.watches {
+		if isUnder(pth, oldPth) {
+			moved = append(moved, pth)
+		}
+	}
+	for _, pth := range moved {
+		delete(w.watches, pth)
+		to := newPth + pth[len(oldPth):]
+		if root == "" || w.skipDir(root, to) {
+			w.raw.Remove(pth)
+			continue
+		}
+		if err := w.raw.Add(to); err == nil {
+			w.watches[to] = true
+		}
+	}
+	w.watchesLock.Unlock()
+
+	w.moveCreated(oldPth, newPth)
+
+	// try again at the new paths, their scans do not know them
+	for _, dir := range w.forgetUnwatched(oldPth) {
+		if root == "" {
+			continue
+		}
+		if err := w.recursiveAdd(newPth + dir[len(oldPth):]); err != nil {
+			w.report(err)
+		}
+	}
+}
+
+// dropWatches removes the watches of a directory moved out of the roots.
+func (w *LinuxWatcher) dropWatches(dir string) {
+	w.watchesLock.Lock()
+	for pth := range w.watches {
+		if isUnder(pth, dir) {
+			w.raw.Remove(pth)
+			delete(w.watches, pth)
+		}
+	}
+	w.watchesLock.Unlock()
+	w.forgetUnwatched(dir)
+}
+
+func (w *LinuxWatcher) forgetWatch(pth string) {
+	w.watchesLock.Lock()
+	delete(w.watches, pth)
+	w.watchesLock.Unlock()
+}
+
 func isDir(e fsnotify.Event) bool {
 	return e.RawOp&syscall.IN_ISDIR == syscall.IN_ISDIR
 }
 
 func (w *LinuxWatcher) translateEvents() {
-	defer func() {
-		close(w.events)
-		close(w.errors)
-	}()
+	var last fsnotify.Event
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	var pollC <-chan time.Time
+	if w.opts.pollFallback {
+		ticker := time.NewTicker(w.opts.pollInterval)
+		defer ticker.Stop()
+		pollC = ticker.C
+	}
 
 	for {
+		var timerC <-chan time.Time
+		if deadline, ok := w.nextDeadline(); ok {
+			timer.Reset(time.Until(deadline))
+			timerC = timer.C
+		}
+
 		select {
 		case <-w.quitCh:
 			return
 		case err, ok := <-w.raw.Errors:
 			if !ok {
+				w.stopped()
 				return
 			}
-			w.errors <- err
+			w.report(backendError(err))
 		case event, ok := <-w.raw.Events:
 			if !ok {
+				w.stopped()
 				return
 			}
-			switch {
-			case event.RawOp&syscall.IN_DELETE == syscall.IN_DELETE:
-				w.events <- newEvent(event.Name, Remove, isDir(event))
-			case event.RawOp&syscall.IN_DELETE_SELF == syscall.IN_DELETE_SELF:
-				if w.watchedPath == event.Name {
-					w.errors <- WatchedRootRemovedErr
-				} else {
-					continue
+			w.translate(event, last)
+			last = event
+		case <-timerC:
+		case <-pollC:
+			w.pollUnwatched()
+		}
+		timer.Stop()
+
+		w.flushPending(time.Now())
+	}
+}
+
+// translate turns one kernel event into events of the watcher, prev is the
+// kernel event before it.
+func (w *LinuxWatcher) translate(event, prev fsnotify.Event) {
+	switch {
+	case event.RawOp&syscall.IN_Q_OVERFLOW == syscall.IN_Q_OVERFLOW:
+		// nothing lost can be paired, report what is pending first
+		w.flushPending(time.Now().Add(w.opts.renameTimeout + w.opts.createTimeout))
+		// the queue is shared by all roots
+		for _, root := range w.roots.list() {
+			w.overflow(root)
+		}
+	case event.RawOp&syscall.IN_DELETE == syscall.IN_DELETE:
+		w.unmarkScanned(event.Name)
+		if w.takeCreated(event.Name) {
+			// never reported
+			return
+		}
+		w.emit(newEvent(event.Name, Remove, isDir(event)))
+	case event.RawOp&syscall.IN_DELETE_SELF == syscall.IN_DELETE_SELF:
+		w.forgetWatch(event.Name)
+		if w.roots.has(event.Name) {
+			w.roots.remove(event.Name)
+			w.unindexRoot(event.Name)
+			w.report(&RootRemovedError{Root: event.Name})
+		} else {
+			return
+		}
+	case event.RawOp&syscall.IN_MOVE_SELF == syscall.IN_MOVE_SELF:
+		// other directories are followed by the moves in their parents
+		if w.roots.has(event.Name) {
+			w.roots.remove(event.Name)
+			w.removeWatches(event.Name)
+			w.unindexRoot(event.Name)
+			w.report(&RootMovedError{Root: event.Name})
+		}
+	case event.RawOp&syscall.IN_CREATE == syscall.IN_CREATE:
+		if event.RawOp&syscall.IN_ISDIR == syscall.IN_ISDIR {
+			if err := w.recursiveAdd(event.Name); err != nil {
+				w.report(err)
+			}
+			w.emitCreate(event.Name, true)
+			w.rescan(event.Name)
+		} else {
+			linfo, err := os.Lstat(event.Name)
+			if err != nil {
+				// gone already, its next events still need the Create
+				if !w.addCreated(event.Name) {
+					w.emitCreate(event.Name, false)
 				}
-			case event.RawOp&syscall.IN_CREATE == syscall.IN_CREATE:
-				if event.RawOp&syscall.IN_ISDIR == syscall.IN_ISDIR {
-					w.recursiveAdd(event.Name)
-					w.events <- newEvent(event.Name, Create, isDir(event))
-				} else {
-					info, err := os.Stat(event.Name)
-					if err != nil {
-						continue
-					}
-					linfo, err := os.Lstat(event.Name)
-					if err != nil {
-						continue
-					}
+				return
+			}
+			info, err := os.Stat(event.Name)
+			if err != nil {
+				return
+			}
+
+			if linfo.Mode()&os.ModeSymlink == os.ModeSymlink {
+				if info.IsDir() {
+					if lnk, err := os.Readlink(event.Name); err == nil {
+						if !filepath.IsAbs(lnk) {
+							lnk = filepath.Join(filepath.Dir(event.Name), lnk)
+						}
+
+						parents := []string{} // all parents of this link
 
-					if linfo.Mode()&os.ModeSymlink == os.ModeSymlink {
-						if info.IsDir() {
-							if lnk, err := os.Readlink(event.Name); err == nil {
-								if !filepath.IsAbs(lnk) {
-									lnk = filepath.Join(filepath.Dir(event.Name), lnk)
-								}
-
-								parents := []string{} // all parents of this link
-
-								recursive := false // assume it is not recursive
-								for tmp := lnk; path.Clean(tmp) != "/"; tmp = path.Dir(tmp) {
-									parents = append(parents, tmp)
-								}
-								for _, part := range parents {
-									// if any parent of link path is same file as the file link points to, it is a cycle
-									statB, err := os.Stat(part)
-									if err != nil {
-										continue
-									}
-									if os.SameFile(info, statB) {
-										recursive = true
-										break
-									}
-								}
-
-								if recursive {
-									continue
-								}
-
-								if strings.HasPrefix(lnk, w.watchedPath) {
-									w.recursiveAdd(event.Name)
-									w.events <- newEvent(event.Name, Create, true)
-								}
+						recursive := false // assume it is not recursive
+						for tmp := lnk; path.Clean(tmp) != "/"; tmp = path.Dir(tmp) {
+							parents = append(parents, tmp)
+						}
+						for _, part := range parents {
+							// if any parent of link path is same file as the file link points to, it is a cycle
+							statB, err := os.Stat(part)
+							if err != nil {
+								continue
+							}
+							if os.SameFile(info, statB) {
+								recursive = true
+								break
+							}
+						}
+
+						if recursive {
+							return
+						}
+
+						if isUnder(lnk, w.roots.rootOf(event.Name)) {
+							if err := w.recursiveAdd(event.Name); err != nil {
+								w.report(err)
 							}
-						} else {
-							w.events <- newEvent(event.Name, Create, false)
+							w.emitCreate(event.Name, true)
+							w.rescan(event.Name)
 						}
-					} else {
-						w.createdLock.Lock()
-						w.created[event.Name] = make(chan error, 1)
-						w.created[event.Name] <- nil
-						w.createdLock.Unlock()
 					}
+				} else {
+					w.emitCreate(event.Name, false)
 				}
-			case event.RawOp&syscall.IN_CLOSE_WRITE == syscall.IN_CLOSE_WRITE:
-				w.createdLock.RLock()
-				select {
-				case <-w.created[event.Name]:
-					w.events <- newEvent(event.Name, Create, isDir(event))
-				default:
-					w.events <- newEvent(event.Name, Modify, isDir(event))
-				}
-				w.createdLock.RUnlock()
-
-			case event.RawOp&syscall.IN_MOVED_FROM == syscall.IN_MOVED_FROM:
-				w.movedToLock.Lock()
-				w.movedTo[event.EventID] = make(chan string, 1)
-				w.movedToLock.Unlock()
-
-				go func(event fsnotify.Event) {
-					w.movedToLock.RLock()
-					defer w.movedToLock.RUnlock()
-					select {
-					case <-w.quitCh:
-						return
-					case newPth := <-w.movedTo[event.EventID]:
-						w.events <- newRenameEvent(newPth, event.Name, isDir(event))
-					case <-time.After(500 * time.Millisecond):
-						w.events <- newEvent(event.Name, Remove, isDir(event))
-					}
-				}(event)
+			} else if !w.addCreated(event.Name) {
+				w.emitCreate(event.Name, false)
+			}
+		}
+	case event.RawOp&syscall.IN_CLOSE_WRITE == syscall.IN_CLOSE_WRITE:
+		if w.takeCreated(event.Name) {
+			w.emitCreate(event.Name, isDir(event))
+		} else {
+			w.emit(newEvent(event.Name, Modify, isDir(event)))
+		}
+
+	case event.RawOp&syscall.IN_ATTRIB == syscall.IN_ATTRIB:
+		// a directory reports changes of its own attributes and its
+		// parent reports them again, right after
+		if isDir(event) && prev.Name == event.Name && prev.RawOp == event.RawOp {
+			return
+		}
+		if w.roots.has(event.Name) {
+			return
+		}
+		// Create of a new file follows on IN_CLOSE_WRITE
+		if w.isCreated(event.Name) {
+			return
+		}
+		if _, err := os.Lstat(event.Name); err != nil {
+			return
+		}
+		w.emit(newEvent(event.Name, Attrib, isDir(event)))
 
-			case event.RawOp&syscall.IN_MOVED_TO == syscall.IN_MOVED_TO:
+	case event.RawOp&syscall.IN_MOVED_FROM == syscall.IN_MOVED_FROM:
+		w.unmarkScanned(event.Name)
+		if w.takeCreated(event.Name) {
+			w.emitCreate(event.Name, false)
+		}
+		if !w.addMove(event.EventID, event.Name, isDir(event)) {
+			w.movedOut(event.Name, isDir(event))
+		}
 
-				w.movedToLock.RLock()
-				ch := w.movedTo[event.EventID]
-				w.movedToLock.RUnlock()
+	case event.RawOp&syscall.IN_MOVED_TO == syscall.IN_MOVED_TO:
+		from, ok := w.pairMove(event.EventID, event.Name)
+		if !ok {
+			w.movedIn(event.Name, isDir(event))
+			return
+		}
 
-				go func(event fsnotify.Event) {
-					select {
-					case <-w.quitCh:
-						return
-					case ch <- event.Name:
-					default:
-						w.events <- newEvent(event.Name, Create, isDir(event))
-					}
-				}(event)
+		// before the next event is read, which must carry the new path
+		if isDir(event) {
+			w.moveWatches(from, event.Name)
+		}
+	}
+}
+
+// movedOut reports a path moved out of the roots.
+func (w *LinuxWatcher) movedOut(pth string, dir bool) {
+	if dir {
+		w.dropWatches(pth)
+	}
+	w.emit(newEvent(pth, Remove, dir))
+}
+
+// movedIn reports a path moved into the roots from outside. Directories are
+// watched recursively and with WithMovedContents their entries are reported
+// as created.
+func (w *LinuxWatcher) movedIn(pth string, dir bool) {
+	if dir {
+		if err := w.recursiveAdd(pth); err != nil {
+			w.report(err)
+		}
+	}
+	w.emitCreate(pth, dir)
+	if dir && w.opts.movedContents {
+		w.rescan(pth)
+	}
+}
+
+// rescan reports the entries under the new directory dir as created. They
+// may have been created before the watches under dir were installed and
+// then the kernel does not report them. Entries an earlier rescan reported
+// are skipped.
+func (w *LinuxWatcher) rescan(dir string) {
+	root := w.roots.rootOf(dir)
+	if root == "" {
+		return
+	}
+
+	now := time.Now()
+	w.scannedLock.Lock()
+	for pth, s := range w.scanned {
+		if now.Sub(s.at) > scannedExpiry {
+			delete(w.scanned, pth)
+		}
+	}
+	w.scannedLock.Unlock()
+
+	filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if err != nil || pth == dir {
+			return nil
+		}
+		if info.IsDir() && w.skipDir(root, pth) {
+			return filepath.SkipDir
+		}
+		w.scannedLock.Lock()
+		_, ok := w.scanned[pth]
+		if !ok && len(w.scanned) < maxPending {
+			w.scanned[pth] = scannedEntry{entry: newSnapshotEntry(pth, info), at: now}
+		}
+		w.scannedLock.Unlock()
+		if !ok {
+			w.emit(newEvent(pth, Create, info.IsDir()))
+		}
+		return nil
+	})
+}
+
+// emitCreate reports a path the kernel reported as created. If a rescan
+// reported the same file already, only a change since then is reported.
+func (w *LinuxWatcher) emitCreate(pth string, dir bool) {
+	w.scannedLock.Lock()
+	s, ok := w.scanned[pth]
+	delete(w.scanned, pth)
+	w.scannedLock.Unlock()
+
+	if ok {
+		info, err := os.Lstat(pth)
+		if err != nil {
+			// already gone, its removal follows
+			return
+		}
+		cur := newSnapshotEntry(pth, info)
+		if cur.Dev == s.entry.Dev && cur.Ino == s.entry.Ino {
+			if cur.changed(s.entry) {
+				w.emit(newEvent(pth, Modify, dir))
 			}
+			return
+		}
+	}
+	w.emit(newEvent(pth, Create, dir))
+}
+
+// unmarkScanned forgets the rescanned entries under pth after it was
+// removed or moved away.
+func (w *LinuxWatcher) unmarkScanned(pth string) {
+	w.scannedLock.Lock()
+	defer w.scannedLock.Unlock()
+	for p := range w.scanned {
+		if isUnder(p, pth) {
+			delete(w.scanned, p)
 		}
 	}
 }
+
+// recursiveAdd watches the directories of the tree of root. Directories over
+// the watch limit are left to polling (WithPollFallback) and returned as the
+// Subtrees of a WatchLimitError after the rest of the tree is watched.
 func (w *LinuxWatcher) recursiveAdd(root string) error {
+	watchedRoot := w.roots.rootOf(root)
 
+	var limit *WatchLimitError
 	err := filepath.Walk(root, func(pth string, info os.FileInfo, err error) error {
+		if cerr := w.cancelled(); cerr != nil {
+			return cerr
+		}
 		if err != nil {
-			return err
+			if os.IsNotExist(err) && pth != root {
+				// removed meanwhile
+				return nil
+			}
+			return watchError(pth, err)
 		}
 
 		if info.IsDir() {
-			w.raw.Add(pth)
+			if w.skipDir(watchedRoot, pth) || w.isUnwatched(pth) {
+				return filepath.SkipDir
+			}
+			if err := w.addWatch(pth); err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				werr := watchError(pth, err)
+				lerr, ok := werr.(*WatchLimitError)
+				if !ok {
+					return werr
+				}
+				if limit == nil {
+					limit = lerr
+				}
+				limit.Subtrees = append(limit.Subtrees, pth)
+				w.unwatch(watchedRoot, pth)
+				return filepath.SkipDir
+			}
 		}
 
 		return nil
 	})
+	if err == nil && limit != nil {
+		return limit
+	}
 	return err
 }
 
-func (w *LinuxWatcher) Events() <-chan Event {
-	return w.events
-}
-
-func (w *LinuxWatcher) Errors() <-chan error {
-	return w.errors
+// addWatch watches the directory pth unless the watcher has WithMaxWatches
+// watches already.
+func (w *LinuxWatcher) addWatch(pth string) error {
+	w.watchesLock.Lock()
+	defer w.watchesLock.Unlock()
+	if w.watches[pth] {
+		return nil
+	}
+	if w.opts.maxWatches > 0 && len(w.watches) >= w.opts.maxWatches {
+		return syscall.ENOSPC
+	}
+	// fsnotify watches with IN_ATTRIB among its flags, Attrib relies on it
+	if err := w.raw.Add(pth); err != nil {
+		return err
+	}
+	w.watches[pth] = true
+	return nil
 }
 
+// Close closes the inotify instance and all its watches.
 func (w *LinuxWatcher) Close() error {
-	if w.isClosed {
-		return nil
-	}
-	w.isClosed = true
-	close(w.quitCh)
-	err := w.raw.Close()
-	return err
+	return w.shutdown(w.raw.Close)
 }
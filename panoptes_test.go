@@ -2,8 +2,10 @@ package panoptes_test
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"time"
 
@@ -13,6 +15,14 @@ import (
 )
 
 var _ = Describe("Watcher", func() {
+	watcherSpecs(newWatcher)
+})
+
+var _ = Describe("PollWatcher", func() {
+	watcherSpecs(newPollWatcher)
+})
+
+func watcherSpecs(newWatcher func(path string, opts ...panoptes.Option) panoptes.Watcher) {
 
 	if runtime.GOOS == "darwin" {
 		SetDefaultEventuallyTimeout(10 * time.Second)
@@ -21,10 +31,9 @@ var _ = Describe("Watcher", func() {
 	}
 
 	var dir string
-	var testNum int
 
 	BeforeEach(func() {
-		dir, testNum = sc.NewTest()
+		dir, _ = sc.NewTest()
 		time.Sleep(time.Second)
 	})
 
@@ -142,7 +151,7 @@ var _ = Describe("Watcher", func() {
 		w := newWatcher(dir)
 		defer closeWatcher(w)
 		rename(oldPath, newPath)
-		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: newPath, Op: panoptes.Create})))
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: newPath, Op: panoptes.Create, Root: dir})))
 	})
 
 	It("should fire event when file is moved out of watched folder", func() {
@@ -152,14 +161,309 @@ var _ = Describe("Watcher", func() {
 		w := newWatcher(dir)
 		defer closeWatcher(w)
 		rename(oldPath, newPath)
-		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: oldPath, Op: panoptes.Remove})))
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: oldPath, Op: panoptes.Remove, Root: dir})))
+	})
+
+	It("should report new paths after folder is renamed", func() {
+		mkdir(filepath.Join(dir, "folder"))
+		mkdir(filepath.Join(dir, "folder", "sub"))
+		w := newWatcher(dir)
+		defer closeWatcher(w)
+		e := rename(filepath.Join(dir, "folder"), filepath.Join(dir, "folder2"))
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+		e = createFile(filepath.Join(dir, "folder2", "file.txt"), "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+		e = createFile(filepath.Join(dir, "folder2", "sub", "file.txt"), "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+	})
+
+	It("should stop reporting folders moved out of watched folder", func() {
+		mkdir(filepath.Join(dir, "folder"))
+		out := filepath.Join(dir, "..", "out")
+		defer os.RemoveAll(out)
+		w := newWatcher(dir, panoptes.WithRenameTimeout(50*time.Millisecond))
+		defer closeWatcher(w)
+		rename(filepath.Join(dir, "folder"), out)
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: filepath.Join(dir, "folder"), Op: panoptes.Remove, IsDir: true, Root: dir})))
+		createFile(filepath.Join(out, "file.txt"), "hello world")
+	})
+
+	It("should watch folders moved into watched folder", func() {
+		out := filepath.Join(dir, "..", "out")
+		mkdir(out)
+		mkdir(filepath.Join(out, "sub"))
+		defer os.RemoveAll(out)
+		w := newWatcher(dir)
+		defer closeWatcher(w)
+		rename(out, filepath.Join(dir, "folder"))
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: filepath.Join(dir, "folder"), Op: panoptes.Create, IsDir: true, Root: dir})))
+		e := createFile(filepath.Join(dir, "folder", "sub", "file.txt"), "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+	})
+
+	It("should report contents of folders moved into watched folder", func() {
+		out := filepath.Join(dir, "..", "out")
+		mkdir(out)
+		mkdir(filepath.Join(out, "sub"))
+		createFile(filepath.Join(out, "sub", "file.txt"), "hello world")
+		defer os.RemoveAll(out)
+		w := newWatcher(dir, panoptes.WithMovedContents())
+		defer closeWatcher(w)
+		folder := filepath.Join(dir, "folder")
+		rename(out, folder)
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: folder, Op: panoptes.Create, IsDir: true, Root: dir})))
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: filepath.Join(folder, "sub"), Op: panoptes.Create, IsDir: true, Root: dir})))
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: filepath.Join(folder, "sub", "file.txt"), Op: panoptes.Create, Root: dir})))
+	})
+
+	It("should honor rename timeout option", func() {
+		oldPath := filepath.Join(dir, "file.txt")
+		newPath := filepath.Join(dir, "..", "file.txt")
+		createFile(oldPath, "hello world")
+		w := newWatcher(dir, panoptes.WithRenameTimeout(50*time.Millisecond))
+		defer closeWatcher(w)
+		rename(oldPath, newPath)
+		Eventually(w.Events(), 250*time.Millisecond).Should(Receive(Equal(panoptes.Event{Path: oldPath, Op: panoptes.Remove, Root: dir})))
+	})
+
+	It("should not report events in excluded folders", func() {
+		mkdir(filepath.Join(dir, "node_modules"))
+		mkdir(filepath.Join(dir, "src"))
+		w := newWatcher(dir, panoptes.WithExclude("node_modules", "*.tmp"))
+		defer closeWatcher(w)
+		createFile(filepath.Join(dir, "node_modules", "file.txt"), "hello world")
+		createFile(filepath.Join(dir, "src", "file.tmp"), "hello world")
+		e := createFile(filepath.Join(dir, "src", "file.txt"), "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+	})
+
+	It("should only report events for included paths", func() {
+		mkdir(filepath.Join(dir, "src"))
+		w := newWatcher(dir, panoptes.WithInclude("src/**/*.go"))
+		defer closeWatcher(w)
+		createFile(filepath.Join(dir, "main.go"), "package main")
+		createFile(filepath.Join(dir, "src", "README"), "hello world")
+		e := createFile(filepath.Join(dir, "src", "main.go"), "package main")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+	})
+
+	It("should report renames of folders with an include filter", func() {
+		mkdir(filepath.Join(dir, "src"))
+		createFile(filepath.Join(dir, "src", "a.go"), "package a")
+		w := newWatcher(dir, panoptes.WithInclude("*.go"))
+		defer closeWatcher(w)
+
+		e := rename(filepath.Join(dir, "src"), filepath.Join(dir, "lib"))
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+		e = modifyFile(filepath.Join(dir, "lib", "a.go"), "package lib")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+	})
+
+	It("should skip paths ignored by .gitignore files", func() {
+		ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("build/\n*.log\n!keep.log\n/top.txt\n"), os.ModePerm)
+		mkdir(filepath.Join(dir, "build"))
+		mkdir(filepath.Join(dir, "src"))
+		w := newWatcher(dir, panoptes.WithGitignore())
+		defer closeWatcher(w)
+
+		createFile(filepath.Join(dir, "build", "file.txt"), "hello world")
+		createFile(filepath.Join(dir, "src", "debug.log"), "hello world")
+		createFile(filepath.Join(dir, "top.txt"), "hello world")
+		e := createFile(filepath.Join(dir, "src", "top.txt"), "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+		e = createFile(filepath.Join(dir, "src", "keep.log"), "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+
+		e = modifyFile(filepath.Join(dir, ".gitignore"), "*.log\n")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+		e = createFile(filepath.Join(dir, "build", "file2.txt"), "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+	})
+
+	It("should fail on invalid filter patterns", func() {
+		_, err := panoptes.NewWatcher(dir, panoptes.WithExclude("[a-"))
+		Expect(err).To(HaveOccurred())
 	})
 
 	It("should report error when watched folder is removed", func() {
 		w := newWatcher(dir)
 		defer closeWatcher(w)
 		os.Remove(dir)
-		Eventually(w.Errors()).Should(Receive(Equal(panoptes.WatchedRootRemovedErr)))
+		Eventually(w.Errors()).Should(Receive(Equal(&panoptes.RootRemovedError{Root: dir})))
+	})
+
+	It("should report fatal error when watched folder is moved", func() {
+		w := newWatcher(dir)
+		defer closeWatcher(w)
+		rename(dir, dir+"-moved")
+		var err error
+		Eventually(w.Errors()).Should(Receive(&err))
+		// polling cannot tell a move from a removal
+		Expect(err).To(Or(Equal(&panoptes.RootMovedError{Root: dir}), Equal(&panoptes.RootRemovedError{Root: dir})))
+		Expect(panoptes.IsFatal(err)).To(BeTrue())
+	})
+
+	It("should watch roots added at runtime", func() {
+		other := filepath.Join(dir, "..", "other")
+		mkdir(other)
+		defer os.RemoveAll(other)
+		w := newWatcher(dir)
+		defer closeWatcher(w)
+		Expect(w.Add(other)).To(Succeed())
+		Expect(w.Add(other)).To(Equal(panoptes.RootAlreadyWatchedErr))
+
+		e := createFile(filepath.Join(dir, "file.txt"), "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+
+		pth := filepath.Join(other, "file.txt")
+		createFile(pth, "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: pth, Op: panoptes.Create, Root: filepath.Clean(other)})))
+	})
+
+	It("should stop watching removed roots", func() {
+		other := filepath.Join(dir, "..", "other")
+		mkdir(other)
+		defer os.RemoveAll(other)
+		w := newWatcher(dir)
+		defer closeWatcher(w)
+		Expect(w.Add(other)).To(Succeed())
+		Expect(w.Remove(other)).To(Succeed())
+		Expect(w.Remove(other)).To(Equal(panoptes.RootNotWatchedErr))
+
+		createFile(filepath.Join(other, "file.txt"), "hello world")
+		e := createFile(filepath.Join(dir, "file.txt"), "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+	})
+
+	It("should report offline changes from the state file", func() {
+		state := filepath.Join(dir, "..", "state")
+		defer os.Remove(state)
+
+		createFile(filepath.Join(dir, "modified.txt"), "hello world")
+		createFile(filepath.Join(dir, "removed.txt"), "hello world")
+
+		w := newWatcher(dir, panoptes.WithStateFile(state))
+		closeWatcher(w)
+
+		// created before the remove so that it cannot reuse its inode
+		created := createFile(filepath.Join(dir, "created.txt"), "hello world")
+		removed := remove(filepath.Join(dir, "removed.txt"))
+		modified := modifyFile(filepath.Join(dir, "modified.txt"), "hello")
+		removed.Offline = true
+		created.Offline = true
+		modified.Offline = true
+
+		w = newWatcher(dir, panoptes.WithStateFile(state))
+		defer closeWatcher(w)
+		Eventually(w.Events()).Should(Receive(Equal(removed)))
+		Eventually(w.Events()).Should(Receive(Equal(created)))
+		Eventually(w.Events()).Should(Receive(Equal(modified)))
+
+		e := createFile(filepath.Join(dir, "live.txt"), "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+	})
+
+	It("should fire event when file mode is changed", func() {
+		if runtime.GOOS == "windows" {
+			Skip("attribute changes are modifications on windows")
+		}
+		pth := filepath.Join(dir, "file.txt")
+		createFile(pth, "hello world")
+		w := newWatcher(dir)
+		defer closeWatcher(w)
+		Expect(os.Chmod(pth, 0700)).To(Succeed())
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: pth, Op: panoptes.Attrib, Root: dir})))
+	})
+
+	It("should fire event when mode is changed in a new folder", func() {
+		if runtime.GOOS == "windows" {
+			Skip("attribute changes are modifications on windows")
+		}
+		w := newWatcher(dir)
+		defer closeWatcher(w)
+		sub := filepath.Join(dir, "sub")
+		Eventually(w.Events()).Should(Receive(Equal(mkdir(sub))))
+		pth := filepath.Join(sub, "file.txt")
+		Eventually(w.Events()).Should(Receive(Equal(createFile(pth, "hello world"))))
+
+		Expect(os.Chmod(pth, 0700)).To(Succeed())
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: pth, Op: panoptes.Attrib, Root: dir})))
+		Expect(os.Chmod(sub, 0700)).To(Succeed())
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: sub, Op: panoptes.Attrib, IsDir: true, Root: dir})))
+		Consistently(w.Events()).ShouldNot(Receive())
+	})
+
+	It("should report old and new mode with metadata", func() {
+		if runtime.GOOS == "windows" {
+			Skip("attribute changes are modifications on windows")
+		}
+		pth := filepath.Join(dir, "file.txt")
+		createFile(pth, "hello world")
+		Expect(os.Chmod(pth, 0600)).To(Succeed())
+		w := newWatcher(dir, panoptes.WithMetadata())
+		defer closeWatcher(w)
+		Expect(os.Chmod(pth, 0700)).To(Succeed())
+		var e panoptes.Event
+		Eventually(w.Events()).Should(Receive(&e))
+		Expect(e.Op).To(Equal(panoptes.Attrib))
+		Expect(e.OldMeta).NotTo(BeNil())
+		Expect(e.OldMeta.Mode.Perm()).To(Equal(os.FileMode(0600)))
+		Expect(e.Meta).NotTo(BeNil())
+		Expect(e.Meta.Mode.Perm()).To(Equal(os.FileMode(0700)))
+		Expect(e.Meta.Uid).To(Equal(uint32(os.Getuid())))
+	})
+
+	It("should report file metadata", func() {
+		w := newWatcher(dir, panoptes.WithMetadata())
+		defer closeWatcher(w)
+
+		pth := filepath.Join(dir, "file.txt")
+		createFile(pth, "hello world")
+		var e panoptes.Event
+		Eventually(w.Events()).Should(Receive(&e))
+		Expect(e.Path).To(Equal(pth))
+		Expect(e.Meta).NotTo(BeNil())
+		Expect(e.Meta.Size).To(Equal(int64(len("Hello world!"))))
+		Expect(e.Meta.Mode.IsRegular()).To(BeTrue())
+		Expect(e.Meta.ModTime).NotTo(BeZero())
+
+		lnk := filepath.Join(dir, "link.txt")
+		Expect(os.Symlink("file.txt", lnk)).To(Succeed())
+		Eventually(w.Events()).Should(Receive(&e))
+		Expect(e.Path).To(Equal(lnk))
+		Expect(e.Meta).NotTo(BeNil())
+		Expect(e.Meta.LinkTarget).To(Equal("file.txt"))
+
+		remove(pth)
+		Eventually(w.Events()).Should(Receive(&e))
+		Expect(e.Op).To(Equal(panoptes.Remove))
+		Expect(e.Meta).To(BeNil())
+	})
+
+	It("should suppress modifications that keep the content", func() {
+		w := newWatcher(dir, panoptes.WithContentHash(0))
+		defer closeWatcher(w)
+
+		pth := filepath.Join(dir, "file.txt")
+		e := createFile(pth, "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+		time.Sleep(10 * time.Millisecond)
+		modifyFile(pth, "Hello world!")
+		Consistently(w.Events(), 500*time.Millisecond).ShouldNot(Receive())
+		e = modifyFile(pth, "hello")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+	})
+
+	It("should not hash files over the size limit", func() {
+		w := newWatcher(dir, panoptes.WithContentHash(4))
+		defer closeWatcher(w)
+
+		pth := filepath.Join(dir, "file.txt")
+		e := createFile(pth, "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+		time.Sleep(10 * time.Millisecond)
+		e = modifyFile(pth, "Hello world!")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
 	})
 
 	It("should quit properly", func() {
@@ -170,6 +474,8 @@ var _ = Describe("Watcher", func() {
 		Eventually(w.Events()).Should(BeClosed())
 	})
 
+	// These specs drive every goroutine of the watcher at once, make test
+	// runs them with the race detector.
 	Context("with a lot of files", func() {
 
 		n := 250
@@ -247,6 +553,36 @@ var _ = Describe("Watcher", func() {
 			}
 		})
 
+		It("should work when hundreds of nested folders with files are created at once", func() {
+			w := newWatcher(dir)
+			defer closeWatcher(w)
+			time.Sleep(5 * time.Second)
+
+			// no waiting between the steps, most entries exist before the
+			// watches of their folders
+			expected := map[panoptes.Event]bool{}
+			for i := 0; i < n; i++ {
+				folder := filepath.Join(dir, fmt.Sprintf("folder%d", i))
+				expected[mkdir(folder)] = true
+				expected[mkdir(filepath.Join(folder, "a"))] = true
+				expected[mkdir(filepath.Join(folder, "a", "b"))] = true
+				expected[createFile(filepath.Join(folder, "a", "b", "file.txt"), "ohai")] = true
+			}
+
+			received := map[panoptes.Event]bool{}
+			for len(received) < len(expected) {
+				var e panoptes.Event
+				Eventually(w.Events(), time.Minute).Should(Receive(&e))
+				if e.Op == panoptes.Modify && !e.IsDir {
+					// a rescan can find a file while it is written
+					continue
+				}
+				Expect(received).NotTo(HaveKey(e), "duplicate event")
+				received[e] = true
+			}
+			Expect(received).To(Equal(expected))
+		})
+
 		It("should work when hundreds of folders are deleted at once", func() {
 
 			for i := 0; i < n; i++ {
@@ -278,5 +614,146 @@ var _ = Describe("Watcher", func() {
 				Eventually(w.Events()).Should(Receive(Equal(e)))
 			}
 		})
+
+		It("should keep the changes of each path in order under load", func() {
+			w := newWatcher(dir)
+			defer closeWatcher(w)
+			time.Sleep(5 * time.Second)
+
+			// every event has to make sense after the ones before it
+			exists := map[string]bool{}
+			apply := func(e panoptes.Event) {
+				switch e.Op {
+				case panoptes.Create:
+					Expect(exists).NotTo(HaveKey(e.Path), "create of existing %s", e.Path)
+					exists[e.Path] = true
+				case panoptes.Modify:
+					Expect(exists).To(HaveKey(e.Path), "modify of missing %s", e.Path)
+				case panoptes.Rename:
+					Expect(exists).To(HaveKey(e.OldPath), "rename of missing %s", e.OldPath)
+					Expect(exists).NotTo(HaveKey(e.Path), "rename to existing %s", e.Path)
+					delete(exists, e.OldPath)
+					exists[e.Path] = true
+				case panoptes.Remove:
+					Expect(exists).To(HaveKey(e.Path), "remove of missing %s", e.Path)
+					delete(exists, e.Path)
+				}
+			}
+
+			expected := map[string]bool{}
+			for i := 0; i < n; i++ {
+				pth := filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+				newPth := filepath.Join(dir, fmt.Sprintf("a_file%d.txt", i))
+				createFile(pth, "ohai")
+				rename(pth, newPth)
+				modifyFile(newPth, "hello world")
+				if i%2 == 0 {
+					remove(newPth)
+				} else {
+					expected[newPth] = true
+				}
+			}
+			// the last change, the events before it must have arrived with it
+			done := filepath.Join(dir, "done")
+			mkdir(done)
+			expected[done] = true
+
+			timeout := time.After(time.Minute)
+			for !reflect.DeepEqual(exists, expected) {
+				select {
+				case e := <-w.Events():
+					apply(e)
+				case <-timeout:
+					Fail(fmt.Sprintf("%d paths exist, expected %d", len(exists), len(expected)))
+				}
+			}
+		})
+	})
+}
+
+// polling cannot see a change that keeps size and mtime at all
+var _ = Describe("Watcher with files rewritten in place", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		if runtime.GOOS != "linux" {
+			Skip("relies on the Modify being reported when the file is closed")
+		}
+		dir, _ = sc.NewTest()
+	})
+
+	It("should report new content with the old size and mtime", func() {
+		w := newWatcher(dir, panoptes.WithContentHash(0))
+		defer closeWatcher(w)
+
+		pth := filepath.Join(dir, "file.txt")
+		e := createFile(pth, "hello world")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+		info, err := os.Stat(pth)
+		Expect(err).NotTo(HaveOccurred())
+
+		// like cp -p: same size, other bytes, the mtime restored
+		f, err := os.OpenFile(pth, os.O_WRONLY, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.WriteString("HELLO WORLD?")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Chtimes(pth, info.ModTime(), info.ModTime())).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: pth, Op: panoptes.Modify, Root: dir})))
+		Consistently(w.Events()).ShouldNot(Receive())
+	})
+
+	It("should report new content with the old size and mtime with metadata", func() {
+		pth := filepath.Join(dir, "file.txt")
+		createFile(pth, "hello world")
+		w := newWatcher(dir, panoptes.WithMetadata())
+		defer closeWatcher(w)
+
+		info, err := os.Stat(pth)
+		Expect(err).NotTo(HaveOccurred())
+
+		// like cp -p: same size, other bytes, the mtime restored
+		f, err := os.OpenFile(pth, os.O_WRONLY, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.WriteString("HELLO WORLD?")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.Chtimes(pth, info.ModTime(), info.ModTime())).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+
+		Eventually(w.Events()).Should(Receive(WithTransform(func(e panoptes.Event) panoptes.Op {
+			return e.Op
+		}, Equal(panoptes.Modify))))
+	})
+})
+
+var _ = Describe("Watcher with a state file", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = sc.NewTest()
+	})
+
+	It("should report the changes it did not deliver before Close as offline", func() {
+		state := filepath.Join(dir, "..", "state")
+		defer os.Remove(state)
+
+		// one event waits in Events() and one in the seqChecker
+		w, c := newNativeWatcher(dir, panoptes.WithStateFile(state), panoptes.WithEventBufferSize(1))
+		var created []panoptes.Event
+		for i := 0; i < 5; i++ {
+			created = append(created, createFile(filepath.Join(dir, fmt.Sprintf("file%d.txt", i)), "hello world"))
+		}
+		Eventually(func() int { return w.Stats().Blocked }).ShouldNot(BeZero())
+		Expect(c.Close()).To(Succeed())
+
+		c2 := newWatcher(dir, panoptes.WithStateFile(state))
+		defer closeWatcher(c2)
+		for _, e := range created[2:] {
+			e.Offline = true
+			Eventually(c2.Events()).Should(Receive(Equal(e)))
+		}
 	})
 })
@@ -3,7 +3,9 @@
 package panoptes
 
 import (
+	"context"
 	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -29,18 +31,23 @@ const (
 )
 
 type WinWatcher struct {
-	watchedPath string
-	events      chan Event
-	errors      chan error
-	movedTo     chan string
-	createdLock sync.RWMutex
-	created     map[string]chan error
+	dispatcher
+	createdLock sync.Mutex
+	created     *createQueue
 	raw         *fsnotify.Watcher
-	isClosed    bool
-	quitCh      chan error
 }
 
-func NewWatcher(path string) (w *WinWatcher, err error) {
+func NewWatcher(path string, opts ...Option) (*WinWatcher, error) {
+	return NewWatcherContext(context.Background(), path, opts...)
+}
+
+// NewWatcherContext is NewWatcher bound to ctx, see Watcher.
+func NewWatcherContext(ctx context.Context, path string, opts ...Option) (w *WinWatcher, err error) {
+	o := newOptions(opts)
+	if o.err != nil {
+		return nil, o.err
+	}
+
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return
@@ -49,125 +56,200 @@ func NewWatcher(path string) (w *WinWatcher, err error) {
 	watcher.Recursive = true
 
 	w = &WinWatcher{
-		watchedPath: path,
-		events:      make(chan Event, 1024),
-		errors:      make(chan error),
-		movedTo:     make(chan string),
-		created:     make(map[string]chan error),
-		raw:         watcher,
-		quitCh:      make(chan error),
+		dispatcher: newDispatcher(ctx, o),
+		created:    newCreateQueue(),
+		raw:        watcher,
 	}
 
-	go w.translateEvents()
+	if err := w.loadState(); err != nil {
+		watcher.Close()
+		return nil, err
+	}
 
-	w.raw.Add(path)
+	w.spawn(w.translateEvents)
+
+	if err := w.Add(path); err != nil {
+		w.Close()
+		return nil, err
+	}
+	w.supervise(w.Close)
 
 	return
 }
 
+func (w *WinWatcher) Add(root string) error {
+	root = filepath.Clean(root)
+	if err := w.roots.add(root); err != nil {
+		return err
+	}
+	install := func() (*Snapshot, error) {
+		return nil, watchError(root, w.raw.Add(root))
+	}
+	if err := w.watchRoot(root, install); err != nil {
+		w.roots.remove(root)
+		return err
+	}
+	return nil
+}
+
+func (w *WinWatcher) Remove(root string) error {
+	root = filepath.Clean(root)
+	if err := w.roots.remove(root); err != nil {
+		return err
+	}
+	w.unindexRoot(root)
+	return w.raw.Remove(root)
+}
+
+// Stats reports the state the watcher holds.
+func (w *WinWatcher) Stats() Stats {
+	s := w.stats()
+	w.createdLock.Lock()
+	defer w.createdLock.Unlock()
+	s.PendingCreates = w.created.len()
+	return s
+}
+
+// Unwatched returns nil, a root is watched with one handle.
+func (w *WinWatcher) Unwatched() []string {
+	return nil
+}
+
 func isDir(e fsnotify.Event) bool {
 	return e.RawOp&IN_ISDIR == IN_ISDIR
 }
 
+// translateEvents is the only goroutine that emits events, so they keep the
+// order of the raw ones. The old and new name of a rename are reported one
+// after the other; a move out is the old name without a new one.
 func (w *WinWatcher) translateEvents() {
-
-	defer func() {
-		close(w.errors)
-		close(w.events)
-	}()
+	var movedFrom *fsnotify.Event
+	var movedFromDeadline time.Time
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
 
 	for {
+		var timerC <-chan time.Time
+		deadline, ok := w.nextCreated()
+		if movedFrom != nil && (!ok || movedFromDeadline.Before(deadline)) {
+			deadline, ok = movedFromDeadline, true
+		}
+		if ok {
+			timer.Reset(time.Until(deadline))
+			timerC = timer.C
+		}
+
 		select {
 		case <-w.quitCh:
 			return
 		case err, ok := <-w.raw.Errors:
 			if !ok {
+				w.stopped()
 				return
 			}
-			w.errors <- err
+			w.report(backendError(err))
 
 		case event, ok := <-w.raw.Events:
 			if !ok {
+				w.stopped()
 				return
 			}
 
+			if movedFrom != nil {
+				if event.RawOp&IN_MOVED_TO == IN_MOVED_TO {
+					w.emit(newRenameEvent(event.Name, movedFrom.Name, isDir(*movedFrom)))
+					movedFrom = nil
+					break
+				}
+				w.emit(newEvent(movedFrom.Name, Remove, isDir(*movedFrom)))
+				movedFrom = nil
+			}
+
 			switch {
 			case event.RawOp&IN_DELETE == IN_DELETE:
-				w.events <- newEvent(event.Name, Remove, isDir(event))
+				// a file removed before its Create went out was never reported
+				if !w.takeCreated(event.Name) {
+					w.emit(newEvent(event.Name, Remove, isDir(event)))
+				}
 			case event.RawOp&IN_DELETE_SELF == IN_DELETE_SELF:
-				if event.Name == w.watchedPath {
-					w.errors <- WatchedRootRemovedErr
-				} else {
-					continue
+				if w.roots.has(event.Name) {
+					w.roots.remove(event.Name)
+					w.report(&RootRemovedError{Root: event.Name})
 				}
 			case event.RawOp&IN_CREATE == IN_CREATE:
 				if info, err := os.Stat(event.Name); err == nil {
-					if info.IsDir() {
-						w.events <- newEvent(event.Name, Create, isDir(event))
-					} else {
-						w.createdLock.Lock()
-						w.created[event.Name] = make(chan error, 1)
-						w.created[event.Name] <- nil
-						time.AfterFunc(3*time.Second, func() {
-							w.createdLock.Lock()
-							defer w.createdLock.Unlock()
-							select {
-							case <-w.created[event.Name]:
-								w.events <- newEvent(event.Name, Create, isDir(event))
-							default:
-							}
-						})
-						w.createdLock.Unlock()
+					if info.IsDir() || !w.addCreated(event.Name) {
+						w.emit(newEvent(event.Name, Create, info.IsDir()))
 					}
 				}
 
 			case event.RawOp&IN_MODIFY == IN_MODIFY:
-				w.createdLock.RLock()
-				select {
-				case <-w.created[event.Name]:
-					w.events <- newEvent(event.Name, Create, isDir(event))
-				default:
-					w.events <- newEvent(event.Name, Modify, isDir(event))
+				if w.takeCreated(event.Name) {
+					w.emit(newEvent(event.Name, Create, isDir(event)))
+				} else {
+					w.emit(newEvent(event.Name, Modify, isDir(event)))
 				}
-				w.createdLock.RUnlock()
 
 			case event.RawOp&IN_MOVED_FROM == IN_MOVED_FROM:
-				go func(event fsnotify.Event) {
-					select {
-					case newPth := <-w.movedTo:
-						w.events <- newRenameEvent(newPth, event.Name, isDir(event))
-					case <-time.After(500 * time.Millisecond):
-						w.events <- newEvent(event.Name, Remove, isDir(event))
-					}
-				}(event)
+				movedFrom = &event
+				movedFromDeadline = time.Now().Add(w.opts.renameTimeout)
 
 			case event.RawOp&IN_MOVED_TO == IN_MOVED_TO:
-				go func(event fsnotify.Event) {
-					select {
-					case w.movedTo <- event.Name:
-					default:
-						w.events <- newEvent(event.Name, Create, isDir(event))
-					}
-				}(event)
+				w.emit(newEvent(event.Name, Create, isDir(event)))
+				if isDir(event) && w.opts.movedContents {
+					w.emitContents(event.Name)
+				}
 			}
+
+		case <-timerC:
+		}
+		timer.Stop()
+
+		now := time.Now()
+		if movedFrom != nil && !movedFromDeadline.After(now) {
+			w.emit(newEvent(movedFrom.Name, Remove, isDir(*movedFrom)))
+			movedFrom = nil
+		}
+		for {
+			pth, ok := w.expireCreated(now)
+			if !ok {
+				break
+			}
+			w.emit(newEvent(pth, Create, false))
 		}
 	}
 }
 
-func (w *WinWatcher) Events() <-chan Event {
-	return w.events
+// addCreated holds back the Create of the new file pth until its first
+// write or the create timeout, it reports false if too many are held back.
+func (w *WinWatcher) addCreated(pth string) bool {
+	w.createdLock.Lock()
+	defer w.createdLock.Unlock()
+	return w.created.add(pth, time.Now().Add(w.opts.createTimeout))
 }
 
-func (w *WinWatcher) Errors() <-chan error {
-	return w.errors
+// takeCreated reports whether the Create of pth was held back and forgets
+// it.
+func (w *WinWatcher) takeCreated(pth string) bool {
+	w.createdLock.Lock()
+	defer w.createdLock.Unlock()
+	return w.created.take(pth)
 }
 
+func (w *WinWatcher) nextCreated() (time.Time, bool) {
+	w.createdLock.Lock()
+	defer w.createdLock.Unlock()
+	return w.created.next()
+}
+
+func (w *WinWatcher) expireCreated(now time.Time) (string, bool) {
+	w.createdLock.Lock()
+	defer w.createdLock.Unlock()
+	return w.created.expire(now)
+}
+
+// Close closes the fsnotify watcher of the roots.
 func (w *WinWatcher) Close() error {
-	if w.isClosed {
-		return nil
-	}
-	w.isClosed = true
-	close(w.quitCh)
-	err := w.raw.Close()
-	return err
+	return w.shutdown(w.raw.Close)
 }
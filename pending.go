@@ -0,0 +1,99 @@
+package panoptes
+
+import (
+	"container/list"
+	"time"
+)
+
+// maxPending bounds each kind of pairing state. When it is full, changes
+// are reported without waiting: a new file as created right away, a move
+// out as a removal.
+const maxPending = 1 << 16
+
+// pendingCreate is a new file that waits for its first write to end, or for
+// the create timeout, before it is reported.
+type pendingCreate struct {
+	path     string
+	deadline time.Time
+}
+
+// createQueue holds back the Creates of new files. All of them wait equally
+// long, so the oldest expires first. It is only used by the goroutine that
+// translates events, callers lock it for Stats.
+type createQueue struct {
+	order *list.List // of *pendingCreate, oldest first
+	paths map[string]*list.Element
+}
+
+func newCreateQueue() *createQueue {
+	return &createQueue{
+		order: list.New(),
+		paths: make(map[string]*list.Element),
+	}
+}
+
+// add holds back the Create of pth until deadline and reports false if too
+// many Creates are held back already.
+func (q *createQueue) add(pth string, deadline time.Time) bool {
+	q.take(pth)
+	if len(q.paths) >= maxPending {
+		return false
+	}
+	q.paths[pth] = q.order.PushBack(&pendingCreate{path: pth, deadline: deadline})
+	return true
+}
+
+// take reports whether the Create of pth was held back and forgets it.
+func (q *createQueue) take(pth string) bool {
+	el, ok := q.paths[pth]
+	if ok {
+		q.order.Remove(el)
+		delete(q.paths, pth)
+	}
+	return ok
+}
+
+func (q *createQueue) has(pth string) bool {
+	_, ok := q.paths[pth]
+	return ok
+}
+
+// move moves the held back Creates under oldPth to newPth.
+func (q *createQueue) move(oldPth, newPth string) {
+	var moved []*list.Element
+	for pth, el := range q.paths {
+		if isUnder(pth, oldPth) {
+			delete(q.paths, pth)
+			moved = append(moved, el)
+		}
+	}
+	for _, el := range moved {
+		c := el.Value.(*pendingCreate)
+		c.path = newPth + c.path[len(oldPth):]
+		q.paths[c.path] = el
+	}
+}
+
+// next returns when the oldest Create expires.
+func (q *createQueue) next() (deadline time.Time, ok bool) {
+	if el := q.order.Front(); el != nil {
+		return el.Value.(*pendingCreate).deadline, true
+	}
+	return
+}
+
+// expire forgets the oldest Create if it expired at now and returns its
+// path.
+func (q *createQueue) expire(now time.Time) (pth string, ok bool) {
+	el := q.order.Front()
+	if el == nil || el.Value.(*pendingCreate).deadline.After(now) {
+		return "", false
+	}
+	c := q.order.Remove(el).(*pendingCreate)
+	delete(q.paths, c.path)
+	return c.path, true
+}
+
+func (q *createQueue) len() int {
+	return len(q.paths)
+}
@@ -0,0 +1,184 @@
+// +build linux
+
+package panoptes
+
+import (
+	"time"
+)
+
+// The linux watcher pairs kernel events in its translating goroutine. A
+// move out waits in an ordered queue for the move in with the same cookie
+// and holds back the events after it, which keeps them in kernel order. A
+// new file waits for its first write to end. All entries of a kind wait
+// equally long, the oldest expires first, so one timer set to the earliest
+// deadline drives both.
+
+// queuedEvent is an event held back behind a move out, or the move out
+// itself until it is paired or expires.
+type queuedEvent struct {
+	event    Event
+	move     bool // still waiting for its move in
+	cookie   uint32
+	deadline time.Time
+}
+
+// emit reports e after the events held back before it. Only the goroutine
+// translating kernel events calls it.
+func (w *LinuxWatcher) emit(e Event) {
+	w.pendingLock.Lock()
+	queued := len(w.queue)
+	if queued > 0 {
+		w.queue = append(w.queue, &queuedEvent{event: e})
+	}
+	w.pendingLock.Unlock()
+
+	switch {
+	case queued == 0:
+		w.dispatcher.emit(e)
+	case queued >= maxPending:
+		// give up waiting for the moves in
+		w.release(time.Now().Add(w.opts.renameTimeout))
+	}
+}
+
+// addMove queues the move out of from and reports false if too many moves
+// wait already.
+func (w *LinuxWatcher) addMove(cookie uint32, from string, dir bool) bool {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	if len(w.moves) >= maxPending {
+		return false
+	}
+	q := &queuedEvent{
+		event:    newEvent(from, Remove, dir),
+		move:     true,
+		cookie:   cookie,
+		deadline: time.Now().Add(w.opts.renameTimeout),
+	}
+	w.queue = append(w.queue, q)
+	w.moves[cookie] = q
+	return true
+}
+
+// pairMove turns the queued move out with cookie into a rename to to. It
+// returns the old path, ok is false if there is no such move.
+func (w *LinuxWatcher) pairMove(cookie uint32, to string) (from string, ok bool) {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	q, ok := w.moves[cookie]
+	if !ok {
+		return "", false
+	}
+	delete(w.moves, cookie)
+	from = q.event.Path
+	q.event = newRenameEvent(to, from, q.event.IsDir)
+	q.move = false
+	return from, true
+}
+
+// addCreated holds back the Create of the new file pth and reports false if
+// too many files are held back already.
+func (w *LinuxWatcher) addCreated(pth string) bool {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	return w.created.add(pth, time.Now().Add(w.opts.createTimeout))
+}
+
+// takeCreated reports whether the Create of pth was held back and forgets
+// it.
+func (w *LinuxWatcher) takeCreated(pth string) bool {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	return w.created.take(pth)
+}
+
+func (w *LinuxWatcher) isCreated(pth string) bool {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	return w.created.has(pth)
+}
+
+// moveCreated moves the held back Creates under oldPth to newPth.
+func (w *LinuxWatcher) moveCreated(oldPth, newPth string) {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	w.created.move(oldPth, newPth)
+}
+
+// nextDeadline returns when the oldest pending entry expires.
+func (w *LinuxWatcher) nextDeadline() (deadline time.Time, ok bool) {
+	w.pendingLock.Lock()
+	defer w.pendingLock.Unlock()
+	if len(w.queue) > 0 && w.queue[0].move {
+		deadline, ok = w.queue[0].deadline, true
+	}
+	if d, pending := w.created.next(); pending && (!ok || d.Before(deadline)) {
+		deadline, ok = d, true
+	}
+	return
+}
+
+// flushPending reports the Creates that waited long enough and the queued
+// events up to the first move that may still be paired.
+func (w *LinuxWatcher) flushPending(now time.Time) {
+	for {
+		w.pendingLock.Lock()
+		pth, ok := w.created.expire(now)
+		w.pendingLock.Unlock()
+		if !ok {
+			break
+		}
+		w.emitCreate(pth, false)
+	}
+	w.release(now)
+}
+
+// release reports the queued events up to the first move that may still be
+// paired at now. Moves that expired are moves out of the roots.
+func (w *LinuxWatcher) release(now time.Time) {
+	for {
+		w.pendingLock.Lock()
+		if len(w.queue) == 0 {
+			w.pendingLock.Unlock()
+			return
+		}
+		q := w.queue[0]
+		movedOut := q.move
+		if movedOut {
+			if q.deadline.After(now) {
+				w.pendingLock.Unlock()
+				return
+			}
+			q.move = false
+			delete(w.moves, q.cookie)
+		}
+		w.queue[0] = nil
+		w.queue = w.queue[1:]
+		w.pendingLock.Unlock()
+
+		if movedOut && q.event.IsDir {
+			w.dropWatches(q.event.Path)
+		}
+		w.dispatcher.emit(q.event)
+	}
+}
+
+// Stats reports the state the watcher holds.
+func (w *LinuxWatcher) Stats() Stats {
+	s := w.stats()
+	w.watchesLock.Lock()
+	s.Watches = len(w.watches)
+	w.watchesLock.Unlock()
+	w.pendingLock.Lock()
+	s.PendingCreates = w.created.len()
+	s.PendingRenames = len(w.moves)
+	s.QueuedEvents = len(w.queue)
+	w.pendingLock.Unlock()
+	w.scannedLock.Lock()
+	s.ScannedPaths = len(w.scanned)
+	w.scannedLock.Unlock()
+	w.unwatchedLock.Lock()
+	s.Unwatched = len(w.unwatched)
+	w.unwatchedLock.Unlock()
+	return s
+}
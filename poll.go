@@ -0,0 +1,313 @@
+package panoptes
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PollWatcher detects changes by periodically scanning the watched trees. It
+// works on file systems without native change notifications (network and
+// FUSE mounts, some overlays) and reports the same events as the native
+// watchers. Renames are detected by matching device and inode numbers, which
+// are not available on windows.
+type PollWatcher struct {
+	dispatcher
+	scansLock sync.Mutex
+	scans     []*pollScan
+	next      int
+}
+
+func NewPollWatcher(path string, opts ...Option) (*PollWatcher, error) {
+	return NewPollWatcherContext(context.Background(), path, opts...)
+}
+
+// NewPollWatcherContext is NewPollWatcher bound to ctx, see Watcher.
+func NewPollWatcherContext(ctx context.Context, path string, opts ...Option) (w *PollWatcher, err error) {
+	o := newOptions(opts)
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	w = &PollWatcher{
+		dispatcher: newDispatcher(ctx, o),
+	}
+
+	if err := w.loadState(); err != nil {
+		return nil, err
+	}
+
+	if err := w.Add(path); err != nil {
+		return nil, err
+	}
+
+	w.spawn(w.poll)
+	w.supervise(w.Close)
+
+	return
+}
+
+// Add scans root once before returning, changes are reported from then on.
+func (w *PollWatcher) Add(root string) error {
+	root = filepath.Clean(root)
+	if _, err := os.Stat(root); err != nil {
+		return err
+	}
+	if err := w.roots.add(root); err != nil {
+		return err
+	}
+
+	s := newPollScan(root)
+	// the index must start from the scan the first poll is compared to
+	install := func() (*Snapshot, error) {
+		if _, _, err := s.step(&w.dispatcher, 0); err != nil || w.index == nil {
+			return nil, err
+		}
+		return s.snapshot.clone(), nil
+	}
+	if err := w.watchRoot(root, install); err != nil {
+		w.roots.remove(root)
+		return err
+	}
+
+	w.scansLock.Lock()
+	w.scans = append(w.scans, s)
+	w.scansLock.Unlock()
+	return nil
+}
+
+func (w *PollWatcher) Remove(root string) error {
+	root = filepath.Clean(root)
+	if err := w.roots.remove(root); err != nil {
+		return err
+	}
+	w.removeScan(root)
+	return nil
+}
+
+// Stats reports the backpressure counters, the scans hold no pending
+// events.
+func (w *PollWatcher) Stats() Stats {
+	return w.stats()
+}
+
+func (w *PollWatcher) removeScan(root string) {
+	w.scansLock.Lock()
+	defer w.scansLock.Unlock()
+	for i, s := range w.scans {
+		if s.root == root {
+			w.scans = append(w.scans[:i], w.scans[i+1:]...)
+			return
+		}
+	}
+}
+
+func (w *PollWatcher) poll() {
+	ticker := time.NewTicker(w.opts.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.quitCh:
+			return
+		case <-ticker.C:
+			w.tick()
+		}
+	}
+}
+
+// tick advances the scans of all roots, starting with a different root each
+// time so that a large tree does not starve the others of the stat budget.
+func (w *PollWatcher) tick() {
+	w.scansLock.Lock()
+	scans := append([]*pollScan(nil), w.scans...)
+	w.scansLock.Unlock()
+
+	if len(scans) == 0 {
+		return
+	}
+
+	budget := w.opts.pollBudget
+	start := w.next % len(scans)
+	w.next++
+
+	for i := range scans {
+		s := scans[(start+i)%len(scans)]
+		old := s.snapshot
+		done, used, err := s.step(&w.dispatcher, budget)
+		if err != nil {
+			if w.cancelled() != nil {
+				return
+			}
+			if w.roots.remove(s.root) == nil {
+				w.removeScan(s.root)
+				w.report(&RootRemovedError{Root: s.root})
+			}
+			continue
+		}
+		if done {
+			for _, e := range Diff(old, s.snapshot) {
+				w.emit(e)
+			}
+		}
+		if budget > 0 {
+			budget -= used
+			if budget <= 0 {
+				return
+			}
+		}
+	}
+}
+
+// Close stops polling, a scan in progress ends early.
+func (w *PollWatcher) Close() error {
+	return w.shutdown(func() error { return nil })
+}
+
+// pollScan walks a tree in steps limited by a stat budget. snapshot holds
+// the result of the last complete pass.
+type pollScan struct {
+	root     string
+	dir      string // where the walk starts, root or a directory under it
+	snapshot *Snapshot
+	pass     *Snapshot
+	queue    []string
+	failing  map[string]bool // directories that could not be listed
+}
+
+func newPollScan(root string) *pollScan {
+	return newSubtreeScan(root, root)
+}
+
+// newSubtreeScan scans the tree of dir under root, without dir itself.
+func newSubtreeScan(root, dir string) *pollScan {
+	return &pollScan{
+		root: root,
+		dir:  dir,
+	}
+}
+
+// step stats up to budget paths, all of them if budget is not positive, and
+// reports whether a pass completed. It fails if the start directory is gone
+// and when the watcher is cancelled or closed.
+func (s *pollScan) step(d *dispatcher, budget int) (done bool, used int, err error) {
+	if s.pass == nil {
+		s.pass = newSnapshot(s.root)
+		s.queue = []string{s.dir}
+	}
+
+	for len(s.queue) > 0 && (budget <= 0 || used < budget) {
+		if err := d.cancelled(); err != nil {
+			s.pass = nil
+			s.queue = nil
+			return false, used, err
+		}
+
+		pth := s.queue[len(s.queue)-1]
+		s.queue = s.queue[:len(s.queue)-1]
+		used++
+
+		info, err := os.Lstat(pth)
+		if err != nil {
+			if pth == s.dir {
+				s.pass = nil
+				s.queue = nil
+				return false, used, err
+			}
+			// gone since its directory was listed, the next pass reports
+			// what happened to it as one change (e.g. a rename)
+			s.keep(pth)
+			continue
+		}
+
+		if pth != s.dir {
+			if info.IsDir() && d.skipDir(s.root, pth) {
+				continue
+			}
+			s.pass.Entries[pth] = newSnapshotEntry(pth, info)
+		}
+
+		if info.IsDir() {
+			names, err := readDirNames(pth)
+			if err != nil {
+				// the entries are not gone because they cannot be listed,
+				// they are kept as the last pass saw them
+				s.keepUnder(pth)
+				s.fail(d, pth, err)
+				continue
+			}
+			delete(s.failing, pth)
+			for i := len(names) - 1; i >= 0; i-- {
+				s.queue = append(s.queue, filepath.Join(pth, names[i]))
+			}
+		}
+	}
+
+	if len(s.queue) > 0 {
+		return false, used, nil
+	}
+
+	s.snapshot = s.pass
+	s.pass = nil
+	for pth := range s.failing {
+		if _, ok := s.snapshot.Entries[pth]; !ok && pth != s.dir {
+			delete(s.failing, pth)
+		}
+	}
+	return true, used, nil
+}
+
+// fail reports that the directory pth could not be listed, once until it
+// can be listed again.
+func (s *pollScan) fail(d *dispatcher, pth string, err error) {
+	if s.failing[pth] {
+		return
+	}
+	if s.failing == nil {
+		s.failing = make(map[string]bool)
+	}
+	s.failing[pth] = true
+	err = watchError(pth, err)
+	d.spawn(func() { d.report(err) })
+}
+
+// keep copies the entries of the tree under pth from the last pass.
+func (s *pollScan) keep(pth string) {
+	if s.snapshot == nil {
+		return
+	}
+	e, ok := s.snapshot.Entries[pth]
+	if !ok {
+		return
+	}
+	s.pass.Entries[pth] = e
+	if e.IsDir {
+		s.keepUnder(pth)
+	}
+}
+
+// keepUnder copies the entries below pth from the last pass.
+func (s *pollScan) keepUnder(pth string) {
+	if s.snapshot == nil {
+		return
+	}
+	for p, e := range s.snapshot.Entries {
+		if p != pth && isUnder(p, pth) {
+			s.pass.Entries[p] = e
+		}
+	}
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	sort.Strings(names)
+	return names, err
+}
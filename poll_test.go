@@ -0,0 +1,66 @@
+package panoptes_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PollWatcher", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = sc.NewTest()
+	})
+
+	It("should spread scans over several intervals when the budget is small", func() {
+		for i := 0; i < 20; i++ {
+			createFile(filepath.Join(dir, fmt.Sprintf("file%d.txt", i)), "hello world")
+		}
+		w := newPollWatcher(dir, panoptes.WithPollInterval(10*time.Millisecond), panoptes.WithPollBudget(3))
+		defer closeWatcher(w)
+
+		e := modifyFile(filepath.Join(dir, "file7.txt"), "hello")
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+	})
+
+	It("should keep the contents of a folder it cannot list", func() {
+		if os.Getuid() == 0 {
+			Skip("root can list every folder")
+		}
+		folder := filepath.Join(dir, "folder")
+		mkdir(folder)
+		createFile(filepath.Join(folder, "file.txt"), "hello world")
+		w := newPollWatcher(dir)
+		defer closeWatcher(w)
+
+		Expect(os.Chmod(folder, 0)).To(Succeed())
+		defer os.Chmod(folder, 0755)
+		var err error
+		Eventually(w.Errors()).Should(Receive(&err))
+		Expect(errors.Is(err, os.ErrPermission)).To(BeTrue())
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: folder, Op: panoptes.Attrib, IsDir: true, Root: dir})))
+		Consistently(w.Events()).ShouldNot(Receive())
+
+		Expect(os.Chmod(folder, 0755)).To(Succeed())
+		Eventually(w.Events()).Should(Receive(Equal(panoptes.Event{Path: folder, Op: panoptes.Attrib, IsDir: true, Root: dir})))
+	})
+
+	It("should report a renamed folder without its contents", func() {
+		mkdir(filepath.Join(dir, "folder"))
+		mkdir(filepath.Join(dir, "folder", "sub"))
+		createFile(filepath.Join(dir, "folder", "sub", "file.txt"), "hello world")
+		w := newPollWatcher(dir)
+		defer closeWatcher(w)
+
+		e := rename(filepath.Join(dir, "folder"), filepath.Join(dir, "folder2"))
+		Eventually(w.Events()).Should(Receive(Equal(e)))
+	})
+})
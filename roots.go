@@ -0,0 +1,82 @@
+package panoptes
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type roots struct {
+	lock  sync.RWMutex
+	paths []string
+}
+
+func newRoots() *roots {
+	return &roots{}
+}
+
+func (r *roots) add(root string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, p := range r.paths {
+		if p == root {
+			return RootAlreadyWatchedErr
+		}
+	}
+	r.paths = append(r.paths, root)
+	return nil
+}
+
+func (r *roots) remove(root string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, p := range r.paths {
+		if p == root {
+			r.paths = append(r.paths[:i], r.paths[i+1:]...)
+			return nil
+		}
+	}
+	return RootNotWatchedErr
+}
+
+func (r *roots) has(root string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, p := range r.paths {
+		if p == root {
+			return true
+		}
+	}
+	return false
+}
+
+// rootOf returns the innermost watched root containing pth or "" if pth is
+// not under any root.
+func (r *roots) rootOf(pth string) string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	root := ""
+	for _, p := range r.paths {
+		if isUnder(pth, p) && len(p) > len(root) {
+			root = p
+		}
+	}
+	return root
+}
+
+func (r *roots) list() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return append([]string(nil), r.paths...)
+}
+
+// isUnder reports whether pth is root itself or inside it.
+func isUnder(pth, root string) bool {
+	if pth == root {
+		return true
+	}
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+	return strings.HasPrefix(pth, root)
+}
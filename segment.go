@@ -0,0 +1,377 @@
+package panoptes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	segmentMagic = "PNSQ1"
+	ackedMagic   = "PNSA1"
+	segmentExt   = ".seg"
+	ackedFile    = "acked"
+	// larger lengths come from garbage at the end of a torn segment
+	maxRecordSize = 1 << 20
+)
+
+// errTornRecord ends a segment whose last record was not written completely,
+// the process stopped while writing it.
+var errTornRecord = fmt.Errorf("Torn record")
+
+// segmentPath returns the path of the segment starting with event first.
+func segmentPath(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", first, segmentExt))
+}
+
+// listSegments returns the first events of the segments in dir, in order.
+func listSegments(dir string) ([]uint64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, first)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i] < segments[j]
+	})
+	return segments, nil
+}
+
+// segmentWriter appends events to a segment file. Each record is its length,
+// the event and a CRC-32 of the event.
+type segmentWriter struct {
+	f    *os.File
+	bw   *bufio.Writer
+	size int64
+	buf  bytes.Buffer
+}
+
+func createSegment(pth string) (*segmentWriter, error) {
+	f, err := os.Create(pth)
+	if err != nil {
+		return nil, err
+	}
+	s := &segmentWriter{f: f, bw: bufio.NewWriter(f)}
+	n, err := io.WriteString(s.bw, segmentMagic)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.size = int64(n)
+	// the file must survive a crash along with the events synced to it
+	if err := syncDir(filepath.Dir(pth)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *segmentWriter) write(e Event) error {
+	s.buf.Reset()
+	encodeEvent(&s.buf, e)
+
+	var head [binary.MaxVarintLen64]byte
+	var sum [4]byte
+	n := binary.PutUvarint(head[:], uint64(s.buf.Len()))
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(s.buf.Bytes()))
+	for _, b := range [][]byte{head[:n], s.buf.Bytes(), sum[:]} {
+		if _, err := s.bw.Write(b); err != nil {
+			return err
+		}
+	}
+	s.size += int64(n + s.buf.Len() + len(sum))
+	return nil
+}
+
+// sync makes the written events durable.
+func (s *segmentWriter) sync() error {
+	if err := s.bw.Flush(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *segmentWriter) close() error {
+	err := s.sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// segmentReader reads the events of a segment file in order.
+type segmentReader struct {
+	f     *os.File
+	br    *bufio.Reader
+	first uint64
+}
+
+func openSegment(dir string, first uint64) (*segmentReader, error) {
+	pth := segmentPath(dir, first)
+	f, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(f)
+	magic := make([]byte, len(segmentMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != segmentMagic {
+		f.Close()
+		return nil, fmt.Errorf("Invalid segment file: %s", pth)
+	}
+	return &segmentReader{f: f, br: br, first: first}, nil
+}
+
+// read returns the next event. It returns io.EOF at the end of the segment
+// and errTornRecord if the last record is incomplete.
+func (s *segmentReader) read() (Event, error) {
+	l, err := binary.ReadUvarint(s.br)
+	if err == io.EOF {
+		return Event{}, io.EOF
+	}
+	if err != nil || l > maxRecordSize {
+		return Event{}, errTornRecord
+	}
+	b := make([]byte, l+4)
+	if _, err := io.ReadFull(s.br, b); err != nil {
+		return Event{}, errTornRecord
+	}
+	if crc32.ChecksumIEEE(b[:l]) != binary.LittleEndian.Uint32(b[l:]) {
+		return Event{}, errTornRecord
+	}
+	return decodeEvent(b[:l])
+}
+
+func (s *segmentReader) close() {
+	s.f.Close()
+}
+
+// lastSeq returns the Seq of the last complete event of the segment, or
+// first-1 if it has none.
+func lastSeq(dir string, first uint64) (uint64, error) {
+	r, err := openSegment(dir, first)
+	if err != nil {
+		return 0, err
+	}
+	defer r.close()
+	last := first - 1
+	for {
+		e, err := r.read()
+		if err == io.EOF || err == errTornRecord {
+			return last, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		last = e.Seq
+	}
+}
+
+const (
+	eventIsDir = 1 << iota
+	eventOffline
+	eventMeta
+	eventOldMeta
+)
+
+func encodeEvent(b *bytes.Buffer, e Event) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(x uint64) {
+		b.Write(buf[:binary.PutUvarint(buf, x)])
+	}
+	putVarint := func(x int64) {
+		b.Write(buf[:binary.PutVarint(buf, x)])
+	}
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		b.WriteString(s)
+	}
+	putMeta := func(m *Metadata) {
+		putVarint(m.Size)
+		putVarint(m.ModTime.UnixNano())
+		putUvarint(uint64(m.Mode))
+		putUvarint(m.Dev)
+		putUvarint(m.Ino)
+		putUvarint(uint64(m.Uid))
+		putUvarint(uint64(m.Gid))
+		putString(m.LinkTarget)
+	}
+
+	flags := uint64(0)
+	if e.IsDir {
+		flags |= eventIsDir
+	}
+	if e.Offline {
+		flags |= eventOffline
+	}
+	if e.Meta != nil {
+		flags |= eventMeta
+	}
+	if e.OldMeta != nil {
+		flags |= eventOldMeta
+	}
+
+	putUvarint(e.Seq)
+	putUvarint(uint64(e.Op))
+	putUvarint(flags)
+	putString(e.Path)
+	putString(e.OldPath)
+	putString(e.Root)
+	if e.Meta != nil {
+		putMeta(e.Meta)
+	}
+	if e.OldMeta != nil {
+		putMeta(e.OldMeta)
+	}
+}
+
+func decodeEvent(b []byte) (e Event, err error) {
+	r := bytes.NewReader(b)
+	invalid := fmt.Errorf("Invalid event record")
+
+	getUvarint := func() uint64 {
+		x, rerr := binary.ReadUvarint(r)
+		if rerr != nil {
+			err = invalid
+		}
+		return x
+	}
+	getVarint := func() int64 {
+		x, rerr := binary.ReadVarint(r)
+		if rerr != nil {
+			err = invalid
+		}
+		return x
+	}
+	getString := func() string {
+		l := getUvarint()
+		if err != nil || l > uint64(r.Len()) {
+			err = invalid
+			return ""
+		}
+		s := make([]byte, l)
+		r.Read(s)
+		return string(s)
+	}
+	getMeta := func() *Metadata {
+		m := &Metadata{}
+		m.Size = getVarint()
+		m.ModTime = time.Unix(0, getVarint())
+		m.Mode = os.FileMode(getUvarint())
+		m.Dev = getUvarint()
+		m.Ino = getUvarint()
+		m.Uid = uint32(getUvarint())
+		m.Gid = uint32(getUvarint())
+		m.LinkTarget = getString()
+		return m
+	}
+
+	e.Seq = getUvarint()
+	e.Op = Op(getUvarint())
+	flags := getUvarint()
+	e.Path = getString()
+	e.OldPath = getString()
+	e.Root = getString()
+	e.IsDir = flags&eventIsDir != 0
+	e.Offline = flags&eventOffline != 0
+	if flags&eventMeta != 0 {
+		e.Meta = getMeta()
+	}
+	if flags&eventOldMeta != 0 {
+		e.OldMeta = getMeta()
+	}
+	if err != nil {
+		return Event{}, err
+	}
+	return e, nil
+}
+
+// readAcked returns the Seq of the last acknowledged event, zero if none was.
+func readAcked(dir string) (uint64, error) {
+	pth := filepath.Join(dir, ackedFile)
+	data, err := ioutil.ReadFile(pth)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if !bytes.HasPrefix(data, []byte(ackedMagic)) {
+		return 0, fmt.Errorf("Invalid acked file: %s", pth)
+	}
+	seq, n := binary.Uvarint(data[len(ackedMagic):])
+	if n <= 0 {
+		return 0, fmt.Errorf("Invalid acked file: %s", pth)
+	}
+	return seq, nil
+}
+
+// writeAcked replaces the acked file atomically, like writeState.
+func writeAcked(dir string, seq uint64) (err error) {
+	pth := filepath.Join(dir, ackedFile)
+	f, err := ioutil.TempFile(dir, ackedFile+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	buf := make([]byte, len(ackedMagic)+binary.MaxVarintLen64)
+	copy(buf, ackedMagic)
+	n := len(ackedMagic) + binary.PutUvarint(buf[len(ackedMagic):], seq)
+	if _, err = f.Write(buf[:n]); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), pth); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the files created in and renamed into dir durable. Windows
+// cannot sync a directory, it journals the change itself.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
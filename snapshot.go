@@ -0,0 +1,422 @@
+package panoptes
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Snapshot records the state of a tree at one point in time. Diff of two
+// snapshots returns the same events a watcher would have reported.
+type Snapshot struct {
+	Root    string
+	Entries map[string]SnapshotEntry // by path, the root itself is not included
+}
+
+type SnapshotEntry struct {
+	IsDir   bool // symlinks to directories are directories
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	Dev     uint64
+	Ino     uint64
+	Uid     uint32
+	Gid     uint32
+}
+
+func newSnapshot(root string) *Snapshot {
+	return &Snapshot{
+		Root:    root,
+		Entries: make(map[string]SnapshotEntry),
+	}
+}
+
+func (s *Snapshot) clone() *Snapshot {
+	c := newSnapshot(s.Root)
+	for pth, e := range s.Entries {
+		c.Entries[pth] = e
+	}
+	return c
+}
+
+func newSnapshotEntry(pth string, info os.FileInfo) SnapshotEntry {
+	e := SnapshotEntry{
+		IsDir:   info.IsDir(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+	}
+	e.Dev, e.Ino = fileID(info)
+	e.Uid, e.Gid = fileOwner(info)
+	if info.Mode()&os.ModeSymlink == os.ModeSymlink {
+		if target, err := os.Stat(pth); err == nil {
+			e.IsDir = target.IsDir()
+		}
+	}
+	return e
+}
+
+func (e SnapshotEntry) changed(o SnapshotEntry) bool {
+	return !e.IsDir && (e.Size != o.Size || !e.ModTime.Equal(o.ModTime))
+}
+
+// attribChanged reports changes of mode or owner, which are Attrib events
+// unless the content changed as well.
+func (e SnapshotEntry) attribChanged(o SnapshotEntry) bool {
+	return e.Mode != o.Mode || e.Uid != o.Uid || e.Gid != o.Gid
+}
+
+// TakeSnapshot scans the tree under root. Filter options (WithInclude,
+// WithExclude, WithGitignore) are honored, excluded directories are not
+// entered.
+func TakeSnapshot(root string, opts ...Option) (*Snapshot, error) {
+	o := newOptions(opts)
+	if o.err != nil {
+		return nil, o.err
+	}
+	d := newDispatcher(context.Background(), o)
+	return scanTree(&d, root)
+}
+
+// scanTree returns the snapshot of the tree under root.
+func scanTree(d *dispatcher, root string) (*Snapshot, error) {
+	s := newPollScan(filepath.Clean(root))
+	if _, _, err := s.step(d, 0); err != nil {
+		return nil, err
+	}
+	return s.snapshot, nil
+}
+
+// Diff returns the events that turn old into new. Paths that disappeared and
+// appeared with the same device and inode are renames; the contents of a
+// renamed directory are not reported separately. Changes of mode or owner
+// alone are Attrib events. The events can be applied to old one after
+// another: parents are created or renamed before their children and every
+// path is the one it has at that point. Either snapshot may be nil.
+func Diff(old, new *Snapshot) []Event {
+	root := ""
+	if old == nil {
+		old = &Snapshot{}
+	} else {
+		root = old.Root
+	}
+	if new == nil {
+		new = &Snapshot{}
+	} else {
+		root = new.Root
+	}
+
+	type fileKey struct{ dev, ino uint64 }
+
+	var removed, created, modified, attribs []string
+	for pth, o := range old.Entries {
+		if n, ok := new.Entries[pth]; !ok || n.IsDir != o.IsDir {
+			removed = append(removed, pth)
+		} else if n.changed(o) {
+			modified = append(modified, pth)
+		} else if n.attribChanged(o) {
+			attribs = append(attribs, pth)
+		}
+	}
+	for pth, n := range new.Entries {
+		if o, ok := old.Entries[pth]; !ok || n.IsDir != o.IsDir {
+			created = append(created, pth)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(created)
+	sort.Strings(modified)
+	sort.Strings(attribs)
+
+	removedByID := make(map[fileKey]string)
+	for _, pth := range removed {
+		if o := old.Entries[pth]; o.Ino != 0 {
+			removedByID[fileKey{o.Dev, o.Ino}] = pth
+		}
+	}
+
+	renamedFrom := make(map[string]string)
+	// renamed directories, new path by old path
+	renamedDirs := make(map[string]string)
+	for _, pth := range created {
+		n := new.Entries[pth]
+		if n.Ino == 0 {
+			continue
+		}
+		oldPth, ok := removedByID[fileKey{n.Dev, n.Ino}]
+		if !ok || old.Entries[oldPth].IsDir != n.IsDir {
+			continue
+		}
+		delete(removedByID, fileKey{n.Dev, n.Ino})
+		renamedFrom[oldPth] = pth
+		if n.IsDir {
+			renamedDirs[oldPth] = pth
+		}
+	}
+	renamedTo := make(map[string]string)
+	for from, to := range renamedFrom {
+		renamedTo[to] = from
+	}
+
+	// The events are applied one after another. Removes go first, at the
+	// paths from before any rename, except for trees something is renamed
+	// out of. Renames and creates follow, parents first, then those removes
+	// at the paths the renames left them.
+	events := []Event{}
+	var removedLater []string
+	for i := len(removed) - 1; i >= 0; i-- {
+		pth := removed[i]
+		if _, ok := renamedFrom[pth]; ok {
+			continue
+		}
+		renamedOut := false
+		for from := range renamedFrom {
+			if isUnder(from, pth) {
+				renamedOut = true
+				break
+			}
+		}
+		if renamedOut {
+			removedLater = append(removedLater, pth)
+			continue
+		}
+		events = append(events, Event{Path: pth, Op: Remove, IsDir: old.Entries[pth].IsDir, Root: root})
+	}
+
+	// directories renamed by an event so far, new path by old path
+	moved := make(map[string]string)
+	current := func(pth string) string {
+		for dir := filepath.Dir(pth); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+			if to, ok := moved[dir]; ok {
+				return filepath.Join(to, pth[len(dir):])
+			}
+		}
+		return pth
+	}
+
+	for _, pth := range created {
+		n := new.Entries[pth]
+		oldPth, ok := renamedTo[pth]
+		if !ok {
+			events = append(events, Event{Path: pth, Op: Create, IsDir: n.IsDir, Root: root})
+			continue
+		}
+		if !movedWithParent(oldPth, pth, renamedDirs) {
+			events = append(events, Event{Path: pth, OldPath: current(oldPth), Op: Rename, IsDir: n.IsDir, Root: root})
+			if n.IsDir {
+				moved[oldPth] = pth
+			}
+		}
+		if !n.IsDir && n.changed(old.Entries[oldPth]) {
+			events = append(events, Event{Path: pth, Op: Modify, Root: root})
+		}
+	}
+
+	for _, pth := range removedLater {
+		events = append(events, Event{Path: current(pth), Op: Remove, IsDir: old.Entries[pth].IsDir, Root: root})
+	}
+	for _, pth := range modified {
+		events = append(events, Event{Path: pth, Op: Modify, Root: root})
+	}
+	for _, pth := range attribs {
+		events = append(events, Event{Path: pth, Op: Attrib, IsDir: new.Entries[pth].IsDir, Root: root})
+	}
+
+	return events
+}
+
+// movedWithParent reports whether oldPth was renamed to newPth as part of a
+// rename of one of its parent directories.
+func movedWithParent(oldPth, newPth string, renamedDirs map[string]string) bool {
+	for dir := filepath.Dir(oldPth); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if to, ok := renamedDirs[dir]; ok {
+			rel, err := filepath.Rel(dir, oldPth)
+			return err == nil && filepath.Join(to, rel) == newPth
+		}
+	}
+	return false
+}
+
+const snapshotMagic = "PNS1"
+
+// maxSnapshotPath bounds the path lengths ReadSnapshot accepts, longer ones
+// come from a corrupt snapshot.
+const maxSnapshotPath = 1 << 16
+
+// WriteTo writes s in a compact binary form: paths are stored relative to
+// the root, sorted and prefix compressed, numbers as varints.
+func (s *Snapshot) WriteTo(w io.Writer) (n int64, err error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	putUvarint := func(x uint64) {
+		cw.Write(buf[:binary.PutUvarint(buf, x)])
+	}
+	putVarint := func(x int64) {
+		cw.Write(buf[:binary.PutVarint(buf, x)])
+	}
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		io.WriteString(cw, s)
+	}
+
+	paths := make([]string, 0, len(s.Entries))
+	for pth := range s.Entries {
+		paths = append(paths, pth)
+	}
+	sort.Strings(paths)
+
+	io.WriteString(cw, snapshotMagic)
+	putString(s.Root)
+	putUvarint(uint64(len(paths)))
+
+	prev := ""
+	for _, pth := range paths {
+		rel := relPath(s.Root, pth)
+		shared := 0
+		for shared < len(rel) && shared < len(prev) && rel[shared] == prev[shared] {
+			shared++
+		}
+		putUvarint(uint64(shared))
+		putString(rel[shared:])
+		prev = rel
+
+		e := s.Entries[pth]
+		flags := uint64(0)
+		if e.IsDir {
+			flags |= 1
+		}
+		if e.Uid != 0 || e.Gid != 0 {
+			flags |= 2
+		}
+		putUvarint(flags)
+		putVarint(e.Size)
+		putVarint(e.ModTime.UnixNano())
+		putUvarint(uint64(e.Mode))
+		putUvarint(e.Dev)
+		putUvarint(e.Ino)
+		if flags&2 == 2 {
+			putUvarint(uint64(e.Uid))
+			putUvarint(uint64(e.Gid))
+		}
+	}
+
+	if cw.err == nil {
+		cw.err = cw.w.(*bufio.Writer).Flush()
+	}
+	return cw.n, cw.err
+}
+
+// ReadSnapshot reads a snapshot written by WriteTo.
+func ReadSnapshot(r io.Reader) (s *Snapshot, err error) {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err = io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != snapshotMagic {
+		return nil, fmt.Errorf("Invalid snapshot")
+	}
+
+	readString := func() (string, error) {
+		l, err := binary.ReadUvarint(br)
+		if err != nil {
+			return "", err
+		}
+		if l > maxSnapshotPath {
+			return "", fmt.Errorf("Invalid snapshot")
+		}
+		b := make([]byte, l)
+		_, err = io.ReadFull(br, b)
+		return string(b), err
+	}
+
+	root, err := readString()
+	if err != nil {
+		return nil, err
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	s = newSnapshot(root)
+	prev := ""
+	for i := uint64(0); i < count; i++ {
+		var shared, flags, mode, uid, gid uint64
+		var size, mtime int64
+		var suffix string
+		var e SnapshotEntry
+
+		if shared, err = binary.ReadUvarint(br); err != nil {
+			return nil, err
+		}
+		if shared > uint64(len(prev)) {
+			return nil, fmt.Errorf("Invalid snapshot")
+		}
+		if suffix, err = readString(); err != nil {
+			return nil, err
+		}
+		if flags, err = binary.ReadUvarint(br); err != nil {
+			return nil, err
+		}
+		if size, err = binary.ReadVarint(br); err != nil {
+			return nil, err
+		}
+		if mtime, err = binary.ReadVarint(br); err != nil {
+			return nil, err
+		}
+		if mode, err = binary.ReadUvarint(br); err != nil {
+			return nil, err
+		}
+		if e.Dev, err = binary.ReadUvarint(br); err != nil {
+			return nil, err
+		}
+		if e.Ino, err = binary.ReadUvarint(br); err != nil {
+			return nil, err
+		}
+		if flags&2 == 2 {
+			if uid, err = binary.ReadUvarint(br); err != nil {
+				return nil, err
+			}
+			if gid, err = binary.ReadUvarint(br); err != nil {
+				return nil, err
+			}
+		}
+
+		rel := prev[:shared] + suffix
+		prev = rel
+		e.IsDir = flags&1 == 1
+		e.Size = size
+		e.ModTime = time.Unix(0, mtime)
+		e.Mode = os.FileMode(mode)
+		e.Uid = uint32(uid)
+		e.Gid = uint32(gid)
+		s.Entries[filepath.Join(root, filepath.FromSlash(rel))] = e
+	}
+
+	return s, nil
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,147 @@
+package panoptes_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Snapshot", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = sc.NewTest()
+		watchedRoot = filepath.Clean(dir)
+	})
+
+	snapshot := func(opts ...panoptes.Option) *panoptes.Snapshot {
+		s, err := panoptes.TakeSnapshot(dir, opts...)
+		Expect(err).NotTo(HaveOccurred())
+		return s
+	}
+
+	It("should record files and folders", func() {
+		mkdir(filepath.Join(dir, "folder"))
+		createFile(filepath.Join(dir, "folder", "file.txt"), "hello world")
+		s := snapshot()
+		Expect(s.Entries).To(HaveLen(2))
+		Expect(s.Entries[filepath.Join(dir, "folder")].IsDir).To(BeTrue())
+		Expect(s.Entries[filepath.Join(dir, "folder", "file.txt")].Size).To(BeNumerically(">", 0))
+	})
+
+	It("should skip excluded folders", func() {
+		mkdir(filepath.Join(dir, "node_modules"))
+		createFile(filepath.Join(dir, "node_modules", "file.txt"), "hello world")
+		Expect(snapshot(panoptes.WithExclude("node_modules")).Entries).To(BeEmpty())
+	})
+
+	It("should diff to watcher events", func() {
+		mkdir(filepath.Join(dir, "folder"))
+		createFile(filepath.Join(dir, "folder", "file.txt"), "hello world")
+		createFile(filepath.Join(dir, "modified.txt"), "hello world")
+		createFile(filepath.Join(dir, "removed.txt"), "hello world")
+		createFile(filepath.Join(dir, "renamed.txt"), "hello world")
+		old := snapshot()
+
+		e1 := rename(filepath.Join(dir, "folder"), filepath.Join(dir, "folder2"))
+		e2 := modifyFile(filepath.Join(dir, "modified.txt"), "hello")
+		// created before the remove so that it cannot reuse its inode
+		e5 := createFile(filepath.Join(dir, "created.txt"), "hello world")
+		e3 := remove(filepath.Join(dir, "removed.txt"))
+		e4 := rename(filepath.Join(dir, "renamed.txt"), filepath.Join(dir, "renamed2.txt"))
+
+		Expect(panoptes.Diff(old, snapshot())).To(ConsistOf(e1, e2, e3, e4, e5))
+	})
+
+	It("should order a diff so that it can be applied event by event", func() {
+		j := func(elem ...string) string {
+			return filepath.Join(append([]string{dir}, elem...)...)
+		}
+		mkdir(j("a"))
+		createFile(j("a", "f"), "hello world")
+		createFile(j("a", "g"), "hello world")
+		createFile(j("x"), "hello world")
+		mkdir(j("y"))
+		createFile(j("y", "z"), "hello world")
+		old := snapshot()
+
+		newdir := mkdir(j("newdir"))
+		movedX := rename(j("x"), j("newdir", "x"))
+		movedZ := rename(j("y", "z"), j("newdir", "z"))
+		removedY := remove(j("y"))
+		movedA := rename(j("a"), j("b"))
+		// created before the remove so that it cannot reuse its inode
+		created := createFile(j("b", "h"), "hello world")
+		remove(j("b", "g"))
+		removedG := panoptes.Event{Path: j("a", "g"), Op: panoptes.Remove, Root: watchedRoot}
+
+		Expect(panoptes.Diff(old, snapshot())).To(Equal([]panoptes.Event{
+			removedG, movedA, created, newdir, movedX, movedZ, removedY,
+		}))
+	})
+
+	It("should diff against nil snapshots", func() {
+		e := createFile(filepath.Join(dir, "file.txt"), "hello world")
+		s := snapshot()
+		Expect(panoptes.Diff(nil, s)).To(Equal([]panoptes.Event{e}))
+		e.Op = panoptes.Remove
+		Expect(panoptes.Diff(s, nil)).To(Equal([]panoptes.Event{e}))
+	})
+
+	It("should serialize", func() {
+		mkdir(filepath.Join(dir, "folder"))
+		mkdir(filepath.Join(dir, "folder", "sub"))
+		createFile(filepath.Join(dir, "folder", "sub", "file.txt"), "hello world")
+		createFile(filepath.Join(dir, "folder", "file.txt"), "hello world")
+		s := snapshot()
+
+		buf := &bytes.Buffer{}
+		n, err := s.WriteTo(buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(BeNumerically("==", buf.Len()))
+
+		read, err := panoptes.ReadSnapshot(buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read.Root).To(Equal(s.Root))
+		Expect(read.Entries).To(HaveLen(len(s.Entries)))
+		Expect(panoptes.Diff(s, read)).To(BeEmpty())
+	})
+
+	It("should fail to read garbage", func() {
+		_, err := panoptes.ReadSnapshot(bytes.NewBufferString("garbage"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail to read a corrupt or truncated snapshot", func() {
+		createFile(filepath.Join(dir, "file.txt"), "hello world")
+		buf := &bytes.Buffer{}
+		_, err := snapshot().WriteTo(buf)
+		Expect(err).NotTo(HaveOccurred())
+		data := buf.Bytes()
+
+		for i := 4; i < len(data); i++ {
+			_, err := panoptes.ReadSnapshot(bytes.NewReader(data[:i]))
+			Expect(err).To(HaveOccurred())
+		}
+		// a root of an impossible length
+		corrupt := append([]byte("PNS1"), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f)
+		_, err = panoptes.ReadSnapshot(bytes.NewReader(corrupt))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should not start a watcher from a corrupt state file", func() {
+		state := filepath.Join(dir, "..", "state")
+		defer os.Remove(state)
+		corrupt := append([]byte("PNST1"), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 'P', 'N', 'S', '1', 0xff, 0x7f)
+		Expect(ioutil.WriteFile(state, corrupt, 0600)).To(Succeed())
+
+		_, err := panoptes.NewWatcher(dir, panoptes.WithStateFile(state))
+		Expect(err).To(MatchError(ContainSubstring("Invalid state file")))
+	})
+})
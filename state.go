@@ -0,0 +1,82 @@
+package panoptes
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const stateMagic = "PNST1"
+
+// readState reads the snapshots saved by writeState.
+func readState(path string) ([]*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+
+	magic := make([]byte, len(stateMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != stateMagic {
+		return nil, fmt.Errorf("Invalid state file: %s", path)
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid state file: %s", path)
+	}
+
+	// count comes from the file, it may be garbage
+	var snapshots []*Snapshot
+	for i := uint64(0); i < count; i++ {
+		// ReadSnapshot reuses br, so the snapshots can be read one after another
+		s, err := ReadSnapshot(br)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid state file: %s: %s", path, err)
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, nil
+}
+
+// writeState replaces the state file atomically, a crash leaves the old one.
+func writeState(path string, snapshots []*Snapshot) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	bw := bufio.NewWriter(f)
+	buf := make([]byte, binary.MaxVarintLen64)
+	io.WriteString(bw, stateMagic)
+	bw.Write(buf[:binary.PutUvarint(buf, uint64(len(snapshots)))])
+	for _, s := range snapshots {
+		if _, err = s.WriteTo(bw); err != nil {
+			return err
+		}
+	}
+	if err = bw.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,84 @@
+package panoptes_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/koofr/panoptes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watcher stats", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = sc.NewTest()
+	})
+
+	It("should release pending state", func() {
+		if runtime.GOOS == "darwin" {
+			Skip("fsevents keeps no pending state")
+		}
+		out := filepath.Join(dir, "..", "out")
+		mkdir(out)
+		defer os.RemoveAll(out)
+
+		w, c := newNativeWatcher(dir,
+			panoptes.WithRenameTimeout(50*time.Millisecond),
+			panoptes.WithCreateTimeout(100*time.Millisecond))
+		defer c.Close()
+
+		for i := 0; i < 10; i++ {
+			pth := filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+			createFile(pth, "hello world")
+			rename(pth, filepath.Join(out, fmt.Sprintf("file%d.txt", i)))
+		}
+		// a hard link is never written, it is reported after the create timeout
+		target := filepath.Join(out, "file0.txt")
+		lnk := filepath.Join(dir, "link.txt")
+		Expect(os.Link(target, lnk)).To(Succeed())
+		Eventually(c.Events()).Should(Receive(Equal(panoptes.Event{Path: lnk, Op: panoptes.Create, Root: dir})))
+
+		Eventually(func() panoptes.Stats {
+			s := w.Stats()
+			s.Watches = 0
+			return s
+		}).Should(BeZero())
+	})
+})
+
+var _ = Describe("Watcher event order", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		dir, _ = sc.NewTest()
+	})
+
+	It("should keep events after a move out in order", func() {
+		if runtime.GOOS != "linux" {
+			Skip("only inotify pairs moves in the watcher")
+		}
+		out := filepath.Join(dir, "..", "out")
+		mkdir(out)
+		defer os.RemoveAll(out)
+		createFile(filepath.Join(dir, "file.txt"), "hello world")
+		createFile(filepath.Join(dir, "file2.txt"), "hello world")
+
+		_, c := newNativeWatcher(dir, panoptes.WithRenameTimeout(200*time.Millisecond))
+		defer c.Close()
+
+		rename(filepath.Join(dir, "file.txt"), filepath.Join(out, "file.txt"))
+		e1 := rename(filepath.Join(dir, "file2.txt"), filepath.Join(dir, "file3.txt"))
+		mkdir(filepath.Join(dir, "folder"))
+
+		Eventually(c.Events()).Should(Receive(Equal(panoptes.Event{Path: filepath.Join(dir, "file.txt"), Op: panoptes.Remove, Root: dir})))
+		Eventually(c.Events()).Should(Receive(Equal(e1)))
+		Eventually(c.Events()).Should(Receive(Equal(panoptes.Event{Path: filepath.Join(dir, "folder"), Op: panoptes.Create, IsDir: true, Root: dir})))
+	})
+})
@@ -0,0 +1,109 @@
+// +build linux
+
+package panoptes
+
+import (
+	"sort"
+)
+
+// unwatch records that the tree of dir has no watches and, with
+// WithPollFallback, starts polling it. The first pass is spread over the
+// poll budget like the others and only sets the state later passes are
+// compared to, the tree may be huge.
+func (w *LinuxWatcher) unwatch(root, dir string) {
+	var s *pollScan
+	if w.opts.pollFallback {
+		s = newSubtreeScan(root, dir)
+	}
+	w.unwatchedLock.Lock()
+	w.unwatched[dir] = s
+	w.unwatchedLock.Unlock()
+}
+
+func (w *LinuxWatcher) isUnwatched(dir string) bool {
+	w.unwatchedLock.Lock()
+	defer w.unwatchedLock.Unlock()
+	_, ok := w.unwatched[dir]
+	return ok
+}
+
+// forgetUnwatched forgets the unwatched trees under dir and returns them.
+func (w *LinuxWatcher) forgetUnwatched(dir string) []string {
+	w.unwatchedLock.Lock()
+	defer w.unwatchedLock.Unlock()
+	var dirs []string
+	for pth := range w.unwatched {
+		if isUnder(pth, dir) {
+			delete(w.unwatched, pth)
+			dirs = append(dirs, pth)
+		}
+	}
+	return dirs
+}
+
+// Unwatched returns the directories whose trees have no native watches
+// because the watch limit was reached.
+func (w *LinuxWatcher) Unwatched() []string {
+	w.unwatchedLock.Lock()
+	defer w.unwatchedLock.Unlock()
+	dirs := make([]string, 0, len(w.unwatched))
+	for pth := range w.unwatched {
+		dirs = append(dirs, pth)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// pollUnwatched advances the scans of the unwatched trees and reports what
+// changed in the ones that completed a pass.
+func (w *LinuxWatcher) pollUnwatched() {
+	w.unwatchedLock.Lock()
+	dirs := make([]string, 0, len(w.unwatched))
+	for pth, s := range w.unwatched {
+		if s != nil {
+			dirs = append(dirs, pth)
+		}
+	}
+	w.unwatchedLock.Unlock()
+	if len(dirs) == 0 {
+		return
+	}
+	sort.Strings(dirs)
+
+	// start with a different tree each time, like PollWatcher
+	budget := w.opts.pollBudget
+	start := w.pollNext % len(dirs)
+	w.pollNext++
+
+	for i := range dirs {
+		dir := dirs[(start+i)%len(dirs)]
+		w.unwatchedLock.Lock()
+		s := w.unwatched[dir]
+		w.unwatchedLock.Unlock()
+		if s == nil {
+			continue
+		}
+
+		old := s.snapshot
+		done, used, err := s.step(&w.dispatcher, budget)
+		if err != nil {
+			if w.cancelled() != nil {
+				return
+			}
+			// its directory reports the removal
+			w.forgetUnwatched(dir)
+			continue
+		}
+		if done && old != nil {
+			for _, e := range Diff(old, s.snapshot) {
+				w.emit(e)
+			}
+		}
+		if budget > 0 {
+			budget -= used
+			if budget <= 0 {
+				return
+			}
+		}
+	}
+}